@@ -0,0 +1,136 @@
+package eap
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+// RFC 4187 8.1 / RFC 5448 3.1 - AT_* attribute types used by EAP-AKA'.
+const (
+	AttrRAND            = 1
+	AttrAUTN            = 2
+	AttrRES             = 3
+	AttrAUTS            = 4
+	AttrMAC             = 11
+	AttrNotification    = 12
+	AttrIdentity        = 14
+	AttrClientErrorCode = 22
+	AttrKDFInput        = 23
+	AttrKDF             = 24
+)
+
+// KDFVersion is the only AT_KDF value defined by RFC 5448 for EAP-AKA'.
+const KDFVersion = 1
+
+// PRFPrime implements the PRF' key derivation used throughout RFC 5448 3.4.1:
+//
+//	T0 = empty string (zero length)
+//	T1 = HMAC-SHA-256(K, T0 | S)
+//	T2 = HMAC-SHA-256(K, T1 | S)
+//	...
+//	PRF'(K,S) = T1 | T2 | T3 | ...
+//
+// truncated to numBytes.
+func PRFPrime(key, s []byte, numBytes int) []byte {
+
+	out := make([]byte, 0, numBytes+sha256.Size)
+	t := []byte{}
+	for len(out) < numBytes {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(t)
+		mac.Write(s)
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+
+	return out[:numBytes]
+}
+
+// DeriveCKIKPrime derives CK'/IK' from the Milenage CK/IK per TS 33.402
+// Annex A, using the same FC-prefixed KDF construction as the other 5G
+// key derivation functions (FC = 0x20):
+//
+//	S = FC || access-network-identity || L0 || (SQN xor AK) || L1
+//	CK' || IK' = HMAC-SHA-256(CK || IK, S)
+func DeriveCKIKPrime(ck, ik, sqnXorAK, accessNetworkID []byte) (ckPrime, ikPrime []byte) {
+
+	const fc = 0x20
+
+	s := []byte{fc}
+	s = append(s, accessNetworkID...)
+	s = appendLen16(s, len(accessNetworkID))
+	s = append(s, sqnXorAK...)
+	s = appendLen16(s, len(sqnXorAK))
+
+	key := append(append([]byte{}, ck...), ik...)
+	out := hmac.New(sha256.New, key)
+	out.Write(s)
+	sum := out.Sum(nil)
+
+	ckPrime = sum[:16]
+	ikPrime = sum[16:32]
+	return
+}
+
+func appendLen16(b []byte, n int) []byte {
+	return append(b, uint8(n>>8), uint8(n))
+}
+
+// DeriveKeys derives K_encr, K_aut, K_re, MSK and EMSK from CK'/IK' per
+// RFC 5448 3.3:
+//
+//	MK  = PRF'(IK' | CK', "EAP-AKA'" | Identity)
+//	MK  = K_encr(16) | K_aut(32) | K_re(32) | MSK(64) | EMSK(64)
+func DeriveKeys(identity, ckPrime, ikPrime []byte) (kEncr, kAut, kRe, msk, emsk []byte) {
+
+	const (
+		lenKEncr = 16
+		lenKAut  = 32
+		lenKRe   = 32
+		lenMSK   = 64
+		lenEMSK  = 64
+	)
+
+	key := append(append([]byte{}, ikPrime...), ckPrime...)
+	s := append(append([]byte{}, []byte("EAP-AKA'")...), identity...)
+	mk := PRFPrime(key, s, lenKEncr+lenKAut+lenKRe+lenMSK+lenEMSK)
+
+	kEncr = mk[0:lenKEncr]
+	kAut = mk[lenKEncr : lenKEncr+lenKAut]
+	kRe = mk[lenKEncr+lenKAut : lenKEncr+lenKAut+lenKRe]
+	msk = mk[lenKEncr+lenKAut+lenKRe : lenKEncr+lenKAut+lenKRe+lenMSK]
+	emsk = mk[lenKEncr+lenKAut+lenKRe+lenMSK:]
+	return
+}
+
+// ComputeMAC computes AT_MAC per RFC 4187 10.15: HMAC-SHA-256 keyed by
+// K_aut over the whole EAP packet with the AT_MAC value field (the
+// 2-byte Reserved sub-field plus the 16-byte MAC itself) zeroed out,
+// truncated to the 128 most significant bits.
+func ComputeMAC(kAut []byte, p *Packet) []byte {
+
+	zeroed := *p
+	zeroed.Attrs = make([]Attribute, len(p.Attrs))
+	copy(zeroed.Attrs, p.Attrs)
+	for i, a := range zeroed.Attrs {
+		if a.Type == AttrMAC {
+			zeroed.Attrs[i].Value = make([]byte, 18) // Reserved(2) | MAC(16)
+		}
+	}
+
+	mac := hmac.New(sha256.New, kAut)
+	mac.Write(Encode(&zeroed))
+	sum := mac.Sum(nil)
+	return sum[:16]
+}
+
+// VerifyMAC reports whether the AT_MAC attribute of p matches the MAC
+// computed over p with K_aut. at.Value carries the 2-byte Reserved
+// sub-field ahead of the 16-byte MAC (RFC 4187 8.1).
+func VerifyMAC(kAut []byte, p *Packet) bool {
+	at := p.Find(AttrMAC)
+	if at == nil || len(at.Value) < 18 {
+		return false
+	}
+	return hmac.Equal(at.Value[2:18], ComputeMAC(kAut, p))
+}
@@ -0,0 +1,82 @@
+package eap
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestComputeMACVerifyMACRoundTrip checks that a packet signed with
+// ComputeMAC passes VerifyMAC under the same K_aut, with AT_MAC carrying
+// its 2-byte Reserved sub-field ahead of the 16-byte MAC.
+func TestComputeMACVerifyMACRoundTrip(t *testing.T) {
+	kAut := bytes.Repeat([]byte{0x5a}, 32)
+
+	p := &Packet{
+		Code:       CodeResponse,
+		Identifier: 1,
+		Type:       TypeAKAPrime,
+		Subtype:    SubtypeChallenge,
+		Attrs: []Attribute{
+			{Type: AttrRES, Value: []byte{0x00, 0x40, 0x01, 0x02, 0x03, 0x04}},
+			{Type: AttrMAC, Value: make([]byte, 18)},
+		},
+	}
+
+	mac := ComputeMAC(kAut, p)
+	atMAC := p.Find(AttrMAC)
+	atMAC.Value = append(make([]byte, 2), mac...)
+
+	if !VerifyMAC(kAut, p) {
+		t.Fatalf("VerifyMAC rejected a packet signed by ComputeMAC with the same key")
+	}
+}
+
+// TestVerifyMACMismatch checks that VerifyMAC rejects a packet whose AT_MAC
+// was computed under a different K_aut (network authentication failure).
+func TestVerifyMACMismatch(t *testing.T) {
+	kAut := bytes.Repeat([]byte{0x5a}, 32)
+	otherKAut := bytes.Repeat([]byte{0xa5}, 32)
+
+	p := &Packet{
+		Code:       CodeResponse,
+		Identifier: 1,
+		Type:       TypeAKAPrime,
+		Subtype:    SubtypeChallenge,
+		Attrs: []Attribute{
+			{Type: AttrMAC, Value: make([]byte, 18)},
+		},
+	}
+
+	mac := ComputeMAC(otherKAut, p)
+	p.Find(AttrMAC).Value = append(make([]byte, 2), mac...)
+
+	if VerifyMAC(kAut, p) {
+		t.Fatalf("VerifyMAC accepted a packet signed under a different K_aut")
+	}
+}
+
+// TestDeriveKeysLengths checks that DeriveKeys splits the RFC 5448 3.3 MK
+// into the expected per-key lengths.
+func TestDeriveKeysLengths(t *testing.T) {
+	identity := []byte("0123456789@nai.5gc.mnc001.mcc001.3gppnetwork.org")
+	ckPrime := bytes.Repeat([]byte{0x11}, 16)
+	ikPrime := bytes.Repeat([]byte{0x22}, 16)
+
+	kEncr, kAut, kRe, msk, emsk := DeriveKeys(identity, ckPrime, ikPrime)
+
+	if len(kEncr) != 16 {
+		t.Errorf("len(K_encr) = %d, want 16", len(kEncr))
+	}
+	if len(kAut) != 32 {
+		t.Errorf("len(K_aut) = %d, want 32", len(kAut))
+	}
+	if len(kRe) != 32 {
+		t.Errorf("len(K_re) = %d, want 32", len(kRe))
+	}
+	if len(msk) != 64 {
+		t.Errorf("len(MSK) = %d, want 64", len(msk))
+	}
+	if len(emsk) != 64 {
+		t.Errorf("len(EMSK) = %d, want 64", len(emsk))
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2019-2020 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+// Package eap implements the minimal Extensible Authentication Protocol
+// (EAP, RFC 3748) packet framing needed to carry EAP-AKA' (RFC 5448)
+// exchanges inside a 5GS NAS Authentication Request/Response.
+package eap
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// RFC 3748 4. Packet Format - Code.
+const (
+	CodeRequest  = 1
+	CodeResponse = 2
+	CodeSuccess  = 3
+	CodeFailure  = 4
+)
+
+// RFC 4187 / RFC 5448 - EAP method Type.
+const (
+	TypeIdentity = 1
+	TypeAKA      = 23
+	TypeAKAPrime = 50
+)
+
+// RFC 4187 8.1 / RFC 5448 3.1 - AKA Subtype, carried in the first octet
+// of the Type-Data for Type == TypeAKAPrime.
+const (
+	SubtypeChallenge              = 1
+	SubtypeAuthenticationReject   = 2
+	SubtypeSynchronizationFailure = 3
+	SubtypeIdentity               = 5
+	SubtypeNotification           = 12
+	SubtypeReauthentication       = 13
+	SubtypeClientError            = 14
+)
+
+// Packet is an EAP packet as defined in RFC 3748 4.
+type Packet struct {
+	Code       uint8
+	Identifier uint8
+	Type       uint8
+	Subtype    uint8
+	Attrs      []Attribute
+}
+
+// Attribute is one AT_* attribute as defined in RFC 4187 8.1. Value is the
+// attribute value as carried on the wire: Decode does not strip the RFC
+// 4187 8.1 padding, so attributes with their own actual-length field have
+// to be sliced to that length by the caller.
+type Attribute struct {
+	Type  uint8
+	Value []byte
+}
+
+// Decode parses an EAP/AKA' packet. It expects Code/Type to already be
+// restricted to EAP-Request or EAP-Response carrying Type == TypeAKAPrime;
+// other EAP types are out of scope for gnbsim.
+func Decode(pdu []byte) (p *Packet, err error) {
+
+	if len(pdu) < 5 {
+		return nil, fmt.Errorf("eap: packet too short: %d bytes", len(pdu))
+	}
+
+	p = new(Packet)
+	p.Code = pdu[0]
+	p.Identifier = pdu[1]
+	length := binary.BigEndian.Uint16(pdu[2:4])
+	if int(length) > len(pdu) {
+		return nil, fmt.Errorf("eap: length %d exceeds packet size %d", length, len(pdu))
+	}
+	pdu = pdu[:length]
+
+	p.Type = pdu[4]
+	if p.Type != TypeAKAPrime && p.Type != TypeAKA {
+		return nil, fmt.Errorf("eap: unsupported Type 0x%x", p.Type)
+	}
+
+	body := pdu[5:]
+	if len(body) < 3 {
+		return nil, fmt.Errorf("eap: AKA' body too short")
+	}
+
+	p.Subtype = body[0]
+	// body[1:3] is the reserved field (RFC 4187 8.1).
+	p.Attrs, err = decodeAttrs(body[3:])
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func decodeAttrs(b []byte) (attrs []Attribute, err error) {
+
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return nil, fmt.Errorf("eap: truncated attribute header")
+		}
+
+		attrType := b[0]
+		attrLen := int(b[1]) * 4 // RFC 4187 8.1: length is in multiples of 4 bytes.
+		if attrLen < 4 || attrLen > len(b) {
+			return nil, fmt.Errorf("eap: invalid attribute length for type 0x%x", attrType)
+		}
+
+		attrs = append(attrs, Attribute{Type: attrType, Value: b[2:attrLen]})
+		b = b[attrLen:]
+	}
+
+	return attrs, nil
+}
+
+// Find returns the first attribute of the given type, or nil if absent.
+func (p *Packet) Find(attrType uint8) *Attribute {
+	for i := range p.Attrs {
+		if p.Attrs[i].Type == attrType {
+			return &p.Attrs[i]
+		}
+	}
+	return nil
+}
+
+// Encode serializes an EAP/AKA' packet, padding each attribute value to a
+// multiple of 4 bytes as required by RFC 4187 8.1.
+func Encode(p *Packet) (pdu []byte) {
+
+	body := []byte{p.Subtype, 0x00, 0x00}
+	for _, a := range p.Attrs {
+		body = append(body, encodeAttr(a)...)
+	}
+
+	pdu = make([]byte, 5)
+	pdu[0] = p.Code
+	pdu[1] = p.Identifier
+	pdu[4] = p.Type
+	pdu = append(pdu, body...)
+	binary.BigEndian.PutUint16(pdu[2:4], uint16(len(pdu)))
+
+	return pdu
+}
+
+func encodeAttr(a Attribute) (b []byte) {
+	padded := a.Value
+	if rem := (2 + len(padded)) % 4; rem != 0 {
+		padded = append(padded, make([]byte, 4-rem)...)
+	}
+
+	b = append(b, a.Type, uint8((2+len(padded))/4))
+	b = append(b, padded...)
+	return b
+}
@@ -0,0 +1,103 @@
+// Copyright 2019-2020 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package eap
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestEncodeDecodeRoundTrip checks that Encode is the inverse of Decode for
+// a packet carrying attribute values whose length already lands on a
+// 4-byte attribute boundary (2-byte Type/Length header + value), so no
+// RFC 4187 8.1 padding is introduced to obscure the comparison.
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	rand := bytes.Repeat([]byte{0xab}, 14) // 2(hdr)+14 = 16: already aligned.
+	autn := bytes.Repeat([]byte{0xcd}, 14)
+
+	want := &Packet{
+		Code:       CodeRequest,
+		Identifier: 7,
+		Type:       TypeAKAPrime,
+		Subtype:    SubtypeChallenge,
+		Attrs: []Attribute{
+			{Type: AttrRAND, Value: rand},
+			{Type: AttrAUTN, Value: autn},
+		},
+	}
+
+	got, err := Decode(Encode(want))
+	if err != nil {
+		t.Fatalf("Decode(Encode(want)) failed: %s", err)
+	}
+
+	if got.Code != want.Code || got.Identifier != want.Identifier ||
+		got.Type != want.Type || got.Subtype != want.Subtype {
+		t.Fatalf("round-tripped header mismatch: got %+v, want %+v", got, want)
+	}
+
+	if len(got.Attrs) != len(want.Attrs) {
+		t.Fatalf("round-tripped attribute count = %d, want %d", len(got.Attrs), len(want.Attrs))
+	}
+	for i := range want.Attrs {
+		if got.Attrs[i].Type != want.Attrs[i].Type {
+			t.Errorf("attr %d type = 0x%x, want 0x%x", i, got.Attrs[i].Type, want.Attrs[i].Type)
+		}
+		if !bytes.Equal(got.Attrs[i].Value, want.Attrs[i].Value) {
+			t.Errorf("attr %d value = %x, want %x", i, got.Attrs[i].Value, want.Attrs[i].Value)
+		}
+	}
+}
+
+// TestEncodeAttrLength checks that the emitted Length octet (in units of 4
+// bytes per RFC 4187 8.1) accounts for the Type/Length header itself, both
+// when the value is already aligned and when it needs padding.
+func TestEncodeAttrLength(t *testing.T) {
+	// Type(1) + Length(1) + Value(18) = 20 bytes, already a multiple of 4.
+	aligned := Attribute{Type: AttrMAC, Value: bytes.Repeat([]byte{0x11}, 18)}
+	b := encodeAttr(aligned)
+	if len(b) != 20 {
+		t.Fatalf("encodeAttr(aligned) produced %d bytes, want 20", len(b))
+	}
+	if want := uint8(20 / 4); b[1] != want {
+		t.Fatalf("Length octet = %d, want %d", b[1], want)
+	}
+
+	// Type(1) + Length(1) + Value(16) = 18 bytes: padded up to 20.
+	unaligned := Attribute{Type: AttrRAND, Value: bytes.Repeat([]byte{0x11}, 16)}
+	b = encodeAttr(unaligned)
+	if len(b) != 20 {
+		t.Fatalf("encodeAttr(unaligned) produced %d bytes, want 20", len(b))
+	}
+	if want := uint8(20 / 4); b[1] != want {
+		t.Fatalf("Length octet = %d, want %d", b[1], want)
+	}
+}
+
+// TestDecodeSynchronizationFailureSubtype checks that a
+// Synchronization-Failure (AT_AUTS) packet decodes with its own Subtype and
+// its AT_AUTS attribute intact, rather than being misparsed as a Challenge.
+func TestDecodeSynchronizationFailureSubtype(t *testing.T) {
+	p := &Packet{
+		Code:       CodeRequest,
+		Identifier: 3,
+		Type:       TypeAKAPrime,
+		Subtype:    SubtypeSynchronizationFailure,
+		Attrs: []Attribute{
+			{Type: AttrAUTS, Value: bytes.Repeat([]byte{0x42}, 14)},
+		},
+	}
+
+	got, err := Decode(Encode(p))
+	if err != nil {
+		t.Fatalf("Decode failed: %s", err)
+	}
+	if got.Subtype != SubtypeSynchronizationFailure {
+		t.Fatalf("Subtype = %d, want SubtypeSynchronizationFailure", got.Subtype)
+	}
+	if at := got.Find(AttrAUTS); at == nil {
+		t.Fatalf("AT_AUTS not found in decoded packet")
+	}
+}
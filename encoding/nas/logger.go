@@ -0,0 +1,43 @@
+// Copyright 2019-2020 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package nas
+
+// Logger is the structured logging sink used by every NAS decode/encode
+// path instead of printing to stdout. Messages carry an explanatory string
+// plus free-form key/value context (e.g. "iei", 0x21), so a library
+// consumer can route gnbsim's NAS trace into whatever logging framework it
+// already uses, and so concurrent UE simulations don't interleave garbled
+// stdout output.
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+}
+
+// noopLogger is the default Logger: it discards everything.
+type noopLogger struct{}
+
+func (noopLogger) Debug(string, ...interface{}) {}
+func (noopLogger) Info(string, ...interface{})  {}
+func (noopLogger) Warn(string, ...interface{})  {}
+
+// SetLogger installs l as ue's logger. Passing nil restores the no-op
+// default.
+func (ue *UE) SetLogger(l Logger) {
+	if l == nil {
+		l = noopLogger{}
+	}
+	ue.logger = l
+}
+
+// log returns ue's logger, falling back to the no-op default for a UE
+// that was never passed through SetLogger (e.g. one built directly with
+// NewNAS or a struct literal).
+func (ue *UE) log() Logger {
+	if ue.logger == nil {
+		return noopLogger{}
+	}
+	return ue.logger
+}
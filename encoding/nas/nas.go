@@ -19,23 +19,31 @@ import (
 	"log"
 	"reflect"
 	"strconv"
-	"strings"
 
 	"github.com/wmnsk/milenage"
 )
 
 type UE struct {
-	MSIN             string
-	MCC              int
-	MNC              int
-	RoutingIndicator uint16
-	ProtectionScheme string
-	AuthParam        AuthParam
+	MSIN                   string
+	MCC                    int
+	MNC                    int
+	RoutingIndicator       uint16
+	ProtectionScheme       string
+	HomeNetworkPublicKey   string // hex encoded, format depends on ProtectionScheme.
+	HomeNetworkPublicKeyID uint8
+	AuthParam              AuthParam
 
 	state struct {
 		securityHeaderParsed bool
 	}
 
+	eapAKA    eapAKAPrimeState // set when the Authentication Request selects EAP-AKA'.
+	sec       securityContext  // NAS security context, established at Security Mode Command.
+	smMsgType int              // message type of the last 5GSM message decoded by decSMMessage.
+
+	logger Logger     // structured log sink, defaults to a no-op; see SetLogger.
+	trace  *TraceSink // NAS PDU capture sink, nil unless EnablePcap/SetTraceSink was called.
+
 	indent int // indent for debug print.
 }
 
@@ -57,15 +65,6 @@ var epdStr = map[int]string{
 	EPD5GSMobilityManagement: "5G Mobility Management",
 }
 
-/*
-type NasMessageSM struct {
-	ExtendedProtocolDiscriminator uint8
-	PDUSessionID uint8
-	ProcedureTransactionID uint8
-	MessageType uint8
-}
-*/
-
 // 9.3 Security header type
 const (
 	SecurityHeaderTypePlain = iota
@@ -76,16 +75,26 @@ const (
 // 9.7 Message type
 const (
 	MessageTypeRegistrationRequest    = 0x41
+	MessageTypeRegistrationAccept     = 0x42
+	MessageTypeRegistrationReject     = 0x44
 	MessageTypeAuthenticationRequest  = 0x56
 	MessageTypeAuthenticationResponse = 0x57
 	MessageTypeSecurityModeCommand    = 0x5d
+	MessageTypeSecurityModeComplete   = 0x5e
+	MessageTypeULNASTransport         = 0x67
+	MessageTypeDLNASTransport         = 0x68
 )
 
 var msgTypeStr = map[int]string{
 	MessageTypeRegistrationRequest:    "Registration Request",
+	MessageTypeRegistrationAccept:     "Registration Accept",
+	MessageTypeRegistrationReject:     "Registration Reject",
 	MessageTypeAuthenticationRequest:  "Authentication Request",
 	MessageTypeAuthenticationResponse: "Authentication Response",
 	MessageTypeSecurityModeCommand:    "Security Mode Command",
+	MessageTypeSecurityModeComplete:   "Security Mode Complete",
+	MessageTypeULNASTransport:         "UL NAS Transport",
+	MessageTypeDLNASTransport:         "DL NAS Transport",
 }
 
 const (
@@ -96,6 +105,9 @@ const (
 	ieiAuthParamRES                    = 0x2d
 	ieiUESecurityCapability            = 0x2e
 	ieiAdditional5GSecurityInformation = 0x36
+	ieiEAPMessage                      = 0x78
+	ieiSNSSAI                          = 0x22 // 9.11.2.8, shared by UL/DL NAS TRANSPORT and 5GSM Establishment Accept.
+	ieiDNN                             = 0x25 // 9.11.2.1A, shared the same way.
 	ieiNonSupported                    = 0xff
 )
 
@@ -107,6 +119,11 @@ var ieStr = map[int]string{
 	ieiAuthParamRES:                    "Authentication response parameter IE",
 	ieiUESecurityCapability:            "UE Security Capability IE",
 	ieiAdditional5GSecurityInformation: "Additional 5G Security Information IE",
+	ieiEAPMessage:                      "EAP message IE",
+	ieiSNSSAI:                          "S-NSSAI IE",
+	ieiDNN:                             "DNN IE",
+	ieiSMQoSFlowDescriptions:           "QoS Flow Descriptions IE",
+	ieiSMPDUAddress:                    "PDU Address IE",
 	ieiNonSupported:                    "Non Supported IE",
 }
 
@@ -125,6 +142,8 @@ func NewNAS(filename string) (p *UE) {
 }
 
 func (ue *UE) Decode(pdu *[]byte, length int) (msgType int) {
+	ue.traceDownlink((*pdu)[:length])
+
 	epd := int((*pdu)[0])
 	ue.dprint("EPD: %s (0x%x)", epdStr[epd], epd)
 	*pdu = (*pdu)[1:]
@@ -137,12 +156,26 @@ func (ue *UE) Decode(pdu *[]byte, length int) (msgType int) {
 
 	if secHeader != 0x00 && ue.state.securityHeaderParsed == false {
 		mac := (*pdu)[:4]
-		seq := int((*pdu)[4])
+		seq := (*pdu)[4]
 		ue.dprinti("mac: %x", mac)
 		ue.dprinti("seq: %d", seq)
 		*pdu = (*pdu)[5:]
 		length -= 5
 		ue.state.securityHeaderParsed = true
+
+		if ue.sec.kNASint != nil {
+			ue.sec.dlCount = nextCount(ue.sec.dlCount, seq)
+			body := (*pdu)[:length]
+			if !ue.verifyNASMAC(secHeader, ue.sec.dlCount, directionDownlink, seq, body, mac) {
+				ue.dprinti("NAS-MAC mismatch: dropping downlink NAS message")
+				ue.state.securityHeaderParsed = false
+				return 0
+			}
+			if secHeader == SecurityHeaderTypeIntegrityProtectedAndCiphered {
+				ue.decryptNAS(ue.sec.dlCount, directionDownlink, body)
+			}
+		}
+
 		msgType = ue.Decode(pdu, length)
 		return
 	}
@@ -164,6 +197,9 @@ func (ue *UE) Decode(pdu *[]byte, length int) (msgType int) {
 	case MessageTypeSecurityModeCommand:
 		ue.decSecurityModeCommand(pdu)
 		break
+	case MessageTypeDLNASTransport:
+		ue.decDLNASTransport(pdu)
+		break
 	default:
 		break
 	}
@@ -200,6 +236,16 @@ func (ue *UE) decInformationElement(pdu *[]byte) {
 			ue.decAuthParamRAND(pdu)
 		case ieiAdditional5GSecurityInformation:
 			break
+		case ieiEAPMessage:
+			ue.decEAPMessage(pdu)
+		case ieiSNSSAI:
+			ue.decSNSSAI(pdu)
+		case ieiDNN:
+			ue.decDNNIE(pdu)
+		case ieiSMQoSFlowDescriptions:
+			ue.decQoSFlowDescriptions(pdu)
+		case ieiSMPDUAddress:
+			ue.decPDUAddress(pdu)
 		default:
 			*pdu = []byte{}
 		}
@@ -249,6 +295,8 @@ func (ue *UE) decAuthenticationRequest(pdu *[]byte) {
 		return
 	}
 
+	ue.AuthParam.ck = m.CK
+	ue.AuthParam.ik = m.IK
 	ue.AuthParam.RESstar = ComputeRESstar(ue.MCC, ue.MNC, m.RAND, m.RES, m.CK, m.IK)
 	ue.dprint("RES*: %x", ue.AuthParam.RESstar)
 	ue.dprint("received and calculated MAC values match.")
@@ -269,6 +317,7 @@ func (ue *UE) MakeAuthenticationResponse() (pdu []byte) {
 	binary.Write(data, binary.BigEndian, ue.encAuthParamRes())
 	pdu = data.Bytes()
 
+	ue.traceUplink(pdu)
 	return
 }
 
@@ -298,24 +347,50 @@ func (p *UE) MakeRegistrationRequest() (pdu []byte) {
 	var typeID uint8 = TypeIDSUCI
 	var supiFormat uint8 = SUPIFormatIMSI
 
-	/*
-	 * it doesn't work with "f.length = uint16(unsafe.Sizeof(*f) - 2)"
-	 * because of the octet alignment.
-	 */
-	f.length = 13
 	f.supiFormatAndTypeID = typeID | (supiFormat << 4)
 	f.plmn = encPLMN(p.MCC, p.MNC)
 	f.routingIndicator = encRoutingIndicator(p.RoutingIndicator)
 	f.protectionScheme = encProtectionScheme(p.ProtectionScheme)
-	f.homeNetworkPublicKeyID = 0
-	f.schemeOutput = encSchemeOutput(p.MSIN)
+	f.homeNetworkPublicKeyID = p.HomeNetworkPublicKeyID
+
+	if f.protectionScheme == ProtectionSchemeNull {
+		so := encSchemeOutputNull(p.MSIN)
+		f.schemeOutput = so[:]
+	} else {
+		so, err := p.encSUCISchemeOutput(f.protectionScheme)
+		if err != nil {
+			log.Fatal(err)
+		}
+		f.schemeOutput = so
+	}
+
+	/*
+	 * it doesn't work with "f.length = uint16(unsafe.Sizeof(*f) - 2)"
+	 * because of the octet alignment, and it varies with the protection
+	 * scheme, so it's computed from the encoded fields.
+	 */
+	f.length = uint16(1 + len(f.plmn) + len(f.routingIndicator) + 1 + 1 + len(f.schemeOutput))
 
+	// f.schemeOutput is variable length, so req can't be round-tripped
+	// through binary.Write as a whole (it only handles fixed-size types);
+	// write the fixed fields and the scheme output separately instead, the
+	// same way encPDUSessionEstablishmentRequest builds its variable-length
+	// message body.
 	data := new(bytes.Buffer)
-	binary.Write(data, binary.BigEndian, req)
+	binary.Write(data, binary.BigEndian, req.head)
+	binary.Write(data, binary.BigEndian, req.registrationTypeAndngKSI)
+	binary.Write(data, binary.BigEndian, f.length)
+	binary.Write(data, binary.BigEndian, f.supiFormatAndTypeID)
+	binary.Write(data, binary.BigEndian, f.plmn)
+	binary.Write(data, binary.BigEndian, f.routingIndicator)
+	binary.Write(data, binary.BigEndian, f.protectionScheme)
+	binary.Write(data, binary.BigEndian, f.homeNetworkPublicKeyID)
+	data.Write(f.schemeOutput)
 	binary.Write(data, binary.BigEndian, enc5GMMCapability())
 	binary.Write(data, binary.BigEndian, encUESecurityCapability())
 	pdu = data.Bytes()
 
+	p.traceUplink(pdu)
 	return
 }
 
@@ -331,6 +406,7 @@ func (ue *UE) decSecurityModeCommand(pdu *[]byte) {
 	ue.decInformationElement(pdu)
 	ue.indent--
 
+	ue.deriveNASSecurityContext()
 	return
 }
 
@@ -359,11 +435,17 @@ func encProtectionScheme(profile string) (p uint8) {
 	switch profile {
 	case "null":
 		p = ProtectionSchemeNull
+	case "profileA":
+		p = ProtectionSchemeProfileA
+	case "profileB":
+		p = ProtectionSchemeProfileB
 	}
 	return
 }
 
-func encSchemeOutput(msin string) (so [5]byte) {
+// encSchemeOutputNull builds the SUCI scheme output for
+// ProtectionSchemeNull: the BCD-encoded MSIN in the clear.
+func encSchemeOutputNull(msin string) (so [5]byte) {
 	for i, v := range Str2BCD(msin) {
 		so[i] = v
 	}
@@ -397,7 +479,7 @@ type FiveGSMobileID struct {
 	routingIndicator       [2]uint8
 	protectionScheme       uint8
 	homeNetworkPublicKeyID uint8
-	schemeOutput           [5]uint8
+	schemeOutput           []uint8 // variable length: 5 bytes for null scheme, ephemeralPubKey||ciphertext||MAC for profile A/B.
 }
 
 const (
@@ -435,6 +517,7 @@ func (ue *UE) decABBA(pdu *[]byte) {
 	ue.dprinti("Length: %d", length)
 	ue.dprinti("Value: 0x%02x", abba)
 
+	ue.sec.abba = append([]byte{}, abba...)
 	return
 }
 
@@ -449,6 +532,8 @@ type AuthParam struct {
 	amf      []byte
 	mac      []byte
 	RESstar  []byte
+	ck       []byte
+	ik       []byte
 }
 
 func (ue *UE) decAuthParamAUTN(pdu *[]byte) {
@@ -526,10 +611,12 @@ func (ue *UE) decngKSI(pdu *[]byte) {
 func (ue *UE) decNASSecurityAlgorithms(pdu *[]byte) {
 
 	ue.dprint("NAS Security Algorithms")
-	alg := (*pdu)[:1]
+	alg := (*pdu)[0]
 	ue.dprinti(" NAS Security Algorithms: 0x%02x", alg)
 	*pdu = (*pdu)[1:]
 
+	ue.sec.encAlg = alg >> 4
+	ue.sec.intAlg = alg & 0x0f
 	return
 }
 
@@ -576,7 +663,7 @@ func (ue *UE) decUESecurityCapability(pdu *[]byte) {
 	return
 }
 
-//-----
+// -----
 func Str2BCD(str string) (bcd []byte) {
 
 	byteArray := []byte(str)
@@ -642,10 +729,9 @@ func ComputeRESstar(mcc, mnc int, rand, res, ck, ik []byte) (resstar []byte) {
 	return
 }
 
-//-----
+// -----
 func (ue *UE) dprint(format string, v ...interface{}) {
-	indent := strings.Repeat("  ", ue.indent)
-	fmt.Printf(indent+format+"\n", v...)
+	ue.log().Debug(fmt.Sprintf(format, v...), "indent", ue.indent)
 	return
 }
 
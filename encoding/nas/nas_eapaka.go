@@ -0,0 +1,167 @@
+// Copyright 2019-2020 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package nas
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+
+	"github.com/wmnsk/milenage"
+
+	"github.com/hhorai/gnbsim/encoding/eap"
+)
+
+// EAP-AKA' specific authentication state, filled in when the Authentication
+// Request carries an EAP message IE instead of the AUTN/RAND IEs used by
+// 5G-AKA.
+type eapAKAPrimeState struct {
+	identifier uint8
+	ckPrime    []byte
+	ikPrime    []byte
+	kAut       []byte
+	res        []byte
+}
+
+// 9.11.2.2 EAP message
+func (ue *UE) decEAPMessage(pdu *[]byte) {
+
+	length := int(binary.BigEndian.Uint16((*pdu)[:2]))
+	*pdu = (*pdu)[2:]
+
+	msg := (*pdu)[:length]
+	*pdu = (*pdu)[length:]
+
+	if err := ue.decEAPAKAPrimeChallenge(msg); err != nil {
+		ue.dprinti("EAP-AKA': %s", err)
+	}
+}
+
+// decEAPAKAPrimeChallenge handles the EAP-Request/AKA'-Challenge carried in
+// the EAP message IE: TS 33.501 Annex F, RFC 5448 3.1.
+func (ue *UE) decEAPAKAPrimeChallenge(msg []byte) error {
+
+	p, err := eap.Decode(msg)
+	if err != nil {
+		return err
+	}
+
+	if p.Type != eap.TypeAKAPrime {
+		return fmt.Errorf("not an EAP-AKA' packet (Type 0x%x)", p.Type)
+	}
+	if p.Subtype != eap.SubtypeChallenge {
+		return fmt.Errorf("unexpected AKA' subtype 0x%x", p.Subtype)
+	}
+
+	atRAND := p.Find(eap.AttrRAND)
+	atAUTN := p.Find(eap.AttrAUTN)
+	atKDF := p.Find(eap.AttrKDF)
+	atKDFInput := p.Find(eap.AttrKDFInput)
+	if atRAND == nil || atAUTN == nil || atKDF == nil || atKDFInput == nil {
+		return fmt.Errorf("missing mandatory AT_RAND/AT_AUTN/AT_KDF/AT_KDF_INPUT")
+	}
+	if len(atKDF.Value) < 2 || binary.BigEndian.Uint16(atKDF.Value) != eap.KDFVersion {
+		return fmt.Errorf("unsupported AT_KDF %x", atKDF.Value)
+	}
+
+	rand := atRAND.Value[2:18]
+	autn := atAUTN.Value[2:18]
+	seqxorak := autn[:6]
+	amfBytes := autn[6:8]
+	mac := autn[8:16]
+
+	k, _ := hex.DecodeString(ue.AuthParam.K)
+	opc, _ := hex.DecodeString(ue.AuthParam.OPc)
+	amf := binary.BigEndian.Uint16(amfBytes)
+
+	m := milenage.NewWithOPc(k, opc, rand, 0, amf)
+	m.F2345()
+	for n, v := range seqxorak {
+		m.SQN[n] = v ^ m.AK[n]
+	}
+	m.F1()
+
+	if reflect.DeepEqual(mac, m.MACA) == false {
+		return fmt.Errorf("AUTN MAC mismatch in EAP-AKA' challenge (network authentication failed)")
+	}
+
+	// AT_KDF_INPUT's Value is the 2-byte Actual Network Name Length
+	// followed by the network name itself, then padding to a 4-byte
+	// boundary (RFC 5448 3.1); slice to the actual length, not the padding.
+	nwNameLen := binary.BigEndian.Uint16(atKDFInput.Value[:2])
+	accessNetworkID := atKDFInput.Value[2 : 2+nwNameLen]
+	ckPrime, ikPrime := eap.DeriveCKIKPrime(m.CK, m.IK, seqxorak, accessNetworkID)
+
+	identity := []byte(ue.eapIdentity())
+	_, kAut, _, _, _ := eap.DeriveKeys(identity, ckPrime, ikPrime)
+
+	ue.eapAKA.identifier = p.Identifier
+	ue.eapAKA.ckPrime = ckPrime
+	ue.eapAKA.ikPrime = ikPrime
+	ue.eapAKA.kAut = kAut
+	ue.eapAKA.res = m.RES
+
+	return nil
+}
+
+// eapIdentity returns the NAI used as the "Identity" input to the EAP-AKA'
+// key derivation (RFC 5448 3.2/3.3): the SUCI/SUPI in root NAI form.
+func (ue *UE) eapIdentity() string {
+	return fmt.Sprintf("0%s@nai.5gc.mnc%03d.mcc%03d.3gppnetwork.org",
+		ue.MSIN, ue.MNC, ue.MCC)
+}
+
+// MakeEAPAKAPrimeResponse builds the Authentication Response carrying an
+// EAP-Response/AKA'-Challenge, the sibling of MakeAuthenticationResponse
+// for AUSFs that select EAP-AKA' instead of 5G-AKA.
+func (ue *UE) MakeEAPAKAPrimeResponse() (pdu []byte) {
+
+	// AT_RES value is the "RES Length" in bits (2 bytes) followed by RES
+	// itself, per RFC 4187 8.1.
+	atRES := make([]byte, 2, 2+len(ue.eapAKA.res))
+	binary.BigEndian.PutUint16(atRES, uint16(len(ue.eapAKA.res)*8))
+	atRES = append(atRES, ue.eapAKA.res...)
+
+	p := &eap.Packet{
+		Code:       eap.CodeResponse,
+		Identifier: ue.eapAKA.identifier,
+		Type:       eap.TypeAKAPrime,
+		Subtype:    eap.SubtypeChallenge,
+		Attrs: []eap.Attribute{
+			{Type: eap.AttrRES, Value: atRES},
+			{Type: eap.AttrMAC, Value: make([]byte, 18)}, // Reserved(2) | MAC(16)
+		},
+	}
+	mac := eap.ComputeMAC(ue.eapAKA.kAut, p)
+	atMAC := make([]byte, 2, 18)
+	atMAC = append(atMAC, mac...)
+	p.Find(eap.AttrMAC).Value = atMAC
+
+	msg := eap.Encode(p)
+
+	var h NasMessageMM
+	h.ExtendedProtocolDiscriminator = EPD5GSMobilityManagement
+	h.SecurityHeaderType = SecurityHeaderTypePlain
+	h.MessageType = MessageTypeAuthenticationResponse
+
+	pdu = append(pdu, byte(h.ExtendedProtocolDiscriminator), byte(h.SecurityHeaderType), byte(h.MessageType))
+	pdu = append(pdu, ieiEAPMessage)
+	lenbuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(lenbuf, uint16(len(msg)))
+	pdu = append(pdu, lenbuf...)
+	pdu = append(pdu, msg...)
+
+	ue.traceUplink(pdu)
+	return pdu
+}
+
+// IsEAPAKA reports whether the last Authentication Request selected
+// EAP-AKA' (an EAP message IE) rather than plain 5G-AKA, so callers know
+// whether to build the response with MakeEAPAKAPrimeResponse or
+// MakeAuthenticationResponse.
+func (ue *UE) IsEAPAKA() bool {
+	return ue.eapAKA.kAut != nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2019-2020 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package nas
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/wmnsk/milenage"
+
+	"github.com/hhorai/gnbsim/encoding/eap"
+)
+
+func testEAPAKAPrimeUE() *UE {
+	ue := new(UE)
+	ue.MSIN = "0000000001"
+	ue.MCC = 1
+	ue.MNC = 1
+	ue.AuthParam.K = "465b5ce8b199b49faa5f0a2ee238a6bc"
+	ue.AuthParam.OPc = "cd63cb71954a9f4e48a5994e37a02baf"
+	return ue
+}
+
+func eapAKAPrimeChallenge(subtype uint8, attrs []eap.Attribute) []byte {
+	p := &eap.Packet{
+		Code:       eap.CodeRequest,
+		Identifier: 9,
+		Type:       eap.TypeAKAPrime,
+		Subtype:    subtype,
+		Attrs:      attrs,
+	}
+	return eap.Encode(p)
+}
+
+// validEAPAKAPrimeChallenge builds an EAP-Request/AKA'-Challenge that
+// passes MAC verification against ue's K/OPc, with AT_KDF_INPUT's network
+// name padded to a 4-byte boundary as RFC 5448 3.1 requires, so the test
+// can check that the padding itself isn't fed into the CK'/IK' KDF.
+func validEAPAKAPrimeChallenge(ue *UE, networkName string) (msg []byte, seqxorak, ck, ik []byte) {
+	k, _ := hex.DecodeString(ue.AuthParam.K)
+	opc, _ := hex.DecodeString(ue.AuthParam.OPc)
+	rand := make([]byte, 16)
+	amf := uint16(0x8000)
+
+	m := milenage.NewWithOPc(k, opc, rand, 0, amf)
+	m.F2345()
+	seqxorak = make([]byte, 6) // SQN = 0, so SQN xor AK == AK.
+	copy(seqxorak, m.AK)
+	m.F1()
+
+	autn := append(append([]byte{}, seqxorak...), byte(amf>>8), byte(amf))
+	autn = append(autn, m.MACA...)
+
+	kdf := make([]byte, 2)
+	binary.BigEndian.PutUint16(kdf, eap.KDFVersion)
+
+	kdfInput := make([]byte, 2, 20)
+	binary.BigEndian.PutUint16(kdfInput, uint16(len(networkName)))
+	kdfInput = append(kdfInput, []byte(networkName)...)
+	for len(kdfInput)%4 != 0 {
+		kdfInput = append(kdfInput, 0x00) // pad with bytes that must NOT reach the KDF.
+	}
+
+	msg = eapAKAPrimeChallenge(eap.SubtypeChallenge, []eap.Attribute{
+		{Type: eap.AttrRAND, Value: append(make([]byte, 2), rand...)},
+		{Type: eap.AttrAUTN, Value: append(make([]byte, 2), autn...)},
+		{Type: eap.AttrKDF, Value: kdf},
+		{Type: eap.AttrKDFInput, Value: kdfInput},
+	})
+	return msg, seqxorak, m.CK, m.IK
+}
+
+// TestDecEAPAKAPrimeChallengeAccessNetworkID checks that AT_KDF_INPUT's
+// 4-byte-boundary padding is excluded from the access network identity fed
+// into the CK'/IK' KDF, not just the Actual Network Name Length bytes.
+func TestDecEAPAKAPrimeChallengeAccessNetworkID(t *testing.T) {
+	ue := testEAPAKAPrimeUE()
+	networkName := "WLAN"
+	msg, seqxorak, ck, ik := validEAPAKAPrimeChallenge(ue, networkName)
+
+	if err := ue.decEAPAKAPrimeChallenge(msg); err != nil {
+		t.Fatalf("decEAPAKAPrimeChallenge() = %v, want success", err)
+	}
+
+	wantCKPrime, wantIKPrime := eap.DeriveCKIKPrime(ck, ik, seqxorak, []byte(networkName))
+	if !bytes.Equal(ue.eapAKA.ckPrime, wantCKPrime) || !bytes.Equal(ue.eapAKA.ikPrime, wantIKPrime) {
+		t.Errorf("CK'/IK' derived with a padded access network ID, want it derived with %q alone", networkName)
+	}
+}
+
+// TestDecEAPAKAPrimeChallengeUnknownKDF checks that an AT_KDF value other
+// than RFC 5448's KDFVersion is rejected rather than silently accepted.
+func TestDecEAPAKAPrimeChallengeUnknownKDF(t *testing.T) {
+	ue := testEAPAKAPrimeUE()
+
+	kdf := make([]byte, 2)
+	binary.BigEndian.PutUint16(kdf, eap.KDFVersion+1)
+
+	msg := eapAKAPrimeChallenge(eap.SubtypeChallenge, []eap.Attribute{
+		{Type: eap.AttrRAND, Value: make([]byte, 18)}, // Reserved(2) | RAND(16).
+		{Type: eap.AttrAUTN, Value: make([]byte, 18)}, // Reserved(2) | AUTN(16).
+		{Type: eap.AttrKDF, Value: kdf},
+		{Type: eap.AttrKDFInput, Value: []byte{0x00, 0x00}},
+	})
+
+	err := ue.decEAPAKAPrimeChallenge(msg)
+	if err == nil || !strings.Contains(err.Error(), "AT_KDF") {
+		t.Fatalf("decEAPAKAPrimeChallenge error = %v, want an AT_KDF rejection", err)
+	}
+}
+
+// TestDecEAPAKAPrimeChallengeMACMismatch checks that an AUTN whose MAC does
+// not match the one computed from K/OPc/RAND is rejected as a network
+// authentication failure.
+func TestDecEAPAKAPrimeChallengeMACMismatch(t *testing.T) {
+	ue := testEAPAKAPrimeUE()
+
+	kdf := make([]byte, 2)
+	binary.BigEndian.PutUint16(kdf, eap.KDFVersion)
+
+	msg := eapAKAPrimeChallenge(eap.SubtypeChallenge, []eap.Attribute{
+		{Type: eap.AttrRAND, Value: make([]byte, 18)},
+		{Type: eap.AttrAUTN, Value: make([]byte, 18)}, // all-zero AUTN: bogus MAC
+		{Type: eap.AttrKDF, Value: kdf},
+		{Type: eap.AttrKDFInput, Value: []byte{0x00, 0x00}},
+	})
+
+	err := ue.decEAPAKAPrimeChallenge(msg)
+	if err == nil || !strings.Contains(err.Error(), "AUTN MAC mismatch") {
+		t.Fatalf("decEAPAKAPrimeChallenge error = %v, want an AUTN MAC mismatch", err)
+	}
+}
+
+// TestDecEAPAKAPrimeChallengeSynchronizationFailure checks that a
+// Synchronization-Failure packet (AT_AUTS, no AT_RAND/AT_AUTN) is rejected
+// rather than misparsed as a Challenge.
+func TestDecEAPAKAPrimeChallengeSynchronizationFailure(t *testing.T) {
+	ue := testEAPAKAPrimeUE()
+
+	msg := eapAKAPrimeChallenge(eap.SubtypeSynchronizationFailure, []eap.Attribute{
+		{Type: eap.AttrAUTS, Value: make([]byte, 14)},
+	})
+
+	err := ue.decEAPAKAPrimeChallenge(msg)
+	if err == nil || !strings.Contains(err.Error(), "subtype") {
+		t.Fatalf("decEAPAKAPrimeChallenge error = %v, want an unexpected-subtype rejection", err)
+	}
+}
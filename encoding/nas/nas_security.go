@@ -0,0 +1,333 @@
+// Copyright 2019-2020 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package nas
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// 9.11.3.34 NAS security algorithms - type of ciphering/integrity algorithm
+// (TS 33.501 5.11.2 Table 5.11.2-1), also used as the NAS wire value.
+const (
+	NEA0 = 0
+	NEA1 = 1 // 128-NEA1 (SNOW 3G), not implemented yet.
+	NEA2 = 2 // 128-NEA2 (AES-CTR).
+	NEA3 = 3 // 128-NEA3 (ZUC), not implemented yet.
+
+	NIA0 = 0
+	NIA1 = 1 // 128-NIA1 (SNOW 3G), not implemented yet.
+	NIA2 = 2 // 128-NIA2 (AES-CMAC).
+	NIA3 = 3 // 128-NIA3 (ZUC), not implemented yet.
+)
+
+// TS 24.501 4.4.3.1 - direction bit for the ciphering/integrity input.
+const (
+	directionUplink   = 0
+	directionDownlink = 1
+)
+
+// NAS does not use the EPS "bearer" concept; TS 24.501 reuses the EPS
+// algorithm inputs with BEARER fixed to zero.
+const nasBearer = 0
+
+// securityContext holds the NAS security context established once the UE
+// has processed a Security Mode Command (TS 33.501 6.4.3, A.7, A.8).
+type securityContext struct {
+	abba []byte // from the Authentication Request, needed to derive K_AMF.
+
+	kAmf    []byte
+	kNASenc []byte
+	kNASint []byte
+
+	encAlg uint8
+	intAlg uint8
+
+	ulCount uint32
+	dlCount uint32
+}
+
+// deriveNASSecurityContext derives K_AMF, K_NASenc and K_NASint from the
+// CK/IK computed during the Authentication procedure (TS 33.501 Annex A.7,
+// A.8), and resets the NAS COUNTs for the new security context.
+func (ue *UE) deriveNASSecurityContext() {
+
+	if ue.AuthParam.ck == nil || ue.AuthParam.ik == nil {
+		ue.dprinti("no CK/IK available, cannot derive NAS security context")
+		return
+	}
+
+	supi := fmt.Sprintf("imsi-%03d%02d%s", ue.MCC, ue.MNC, ue.MSIN)
+	ue.sec.kAmf = deriveKAMF(ue.AuthParam.ck, ue.AuthParam.ik, supi, ue.sec.abba)
+	ue.sec.kNASenc = deriveNASAlgKey(ue.sec.kAmf, nasAlgTypeEnc, ue.sec.encAlg)
+	ue.sec.kNASint = deriveNASAlgKey(ue.sec.kAmf, nasAlgTypeInt, ue.sec.intAlg)
+	ue.sec.ulCount = 0
+	ue.sec.dlCount = 0
+
+	ue.dprinti("K_AMF   : %x", ue.sec.kAmf)
+	ue.dprinti("K_NASenc: %x", ue.sec.kNASenc)
+	ue.dprinti("K_NASint: %x", ue.sec.kNASint)
+}
+
+// TS 33.501 A.7 K_AMF derivation function: FC = 0x6D, P0 = SUPI,
+// P1 = ABBA.
+func deriveKAMF(ck, ik []byte, supi string, abba []byte) []byte {
+
+	const fc = 0x6d
+
+	p0 := []byte(supi)
+	s := []byte{fc}
+	s = append(s, p0...)
+	s = append(s, uint8(len(p0)>>8), uint8(len(p0)))
+	s = append(s, abba...)
+	s = append(s, uint8(len(abba)>>8), uint8(len(abba)))
+
+	key := append(append([]byte{}, ck...), ik...)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(s)
+	return mac.Sum(nil)
+}
+
+// TS 33.501 Annex A.8 algorithm type distinguisher for K_NASenc/K_NASint.
+const (
+	nasAlgTypeEnc = 0x01
+	nasAlgTypeInt = 0x02
+)
+
+// deriveNASAlgKey derives a NAS algorithm key from K_AMF (TS 33.501 A.8):
+// FC = 0x69, P0 = algorithm type distinguisher, P1 = algorithm identity.
+// The output is 256 bits; for the 128-bit algorithms implemented here only
+// the 128 least significant bits are used.
+func deriveNASAlgKey(kAmf []byte, algType, algID uint8) []byte {
+
+	const fc = 0x69
+
+	s := []byte{fc, algType, 0x00, 0x01, algID, 0x00, 0x01}
+	mac := hmac.New(sha256.New, kAmf)
+	mac.Write(s)
+	sum := mac.Sum(nil)
+	return sum[len(sum)-16:]
+}
+
+// nextCount folds a received 8-bit SQN into the locally tracked 32-bit NAS
+// COUNT, bumping the overflow counter when the SQN wraps around (TS 24.501
+// 4.4.3.1).
+func nextCount(count uint32, seq uint8) uint32 {
+	if seq < uint8(count) {
+		count += 0x100
+	}
+	return (count &^ 0xff) | uint32(seq)
+}
+
+// verifyNASMAC checks the received NAS-MAC of a secured NAS message against
+// the one computed locally from K_NASint over the given COUNT/BEARER/
+// DIRECTION/SEQ/message, per TS 24.501 4.4.3.1 / TS 33.401 Annex B.
+func (ue *UE) verifyNASMAC(secHeader int, count uint32, direction uint8, seq uint8, body, mac []byte) bool {
+
+	msg := append([]byte{seq}, body...)
+	computed := nasMAC(ue.sec.intAlg, ue.sec.kNASint, count, nasBearer, direction, msg)
+	if computed == nil {
+		ue.dprinti("NAS integrity algorithm %d not implemented", ue.sec.intAlg)
+		return false
+	}
+
+	return hmacEqual(computed, mac)
+}
+
+func hmacEqual(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	var v byte
+	for i := range a {
+		v |= a[i] ^ b[i]
+	}
+	return v == 0
+}
+
+// decryptNAS deciphers a secured NAS message body in place using K_NASenc.
+func (ue *UE) decryptNAS(count uint32, direction uint8, body []byte) {
+	out := nasCipher(ue.sec.encAlg, ue.sec.kNASenc, count, nasBearer, direction, body)
+	if out == nil {
+		ue.dprinti("NAS ciphering algorithm %d not implemented", ue.sec.encAlg)
+		return
+	}
+	copy(body, out)
+}
+
+// nasCipher applies the NEA ciphering algorithm identified by alg. It
+// returns nil if alg is not implemented.
+func nasCipher(alg uint8, key []byte, count uint32, bearer, direction uint8, data []byte) []byte {
+	switch alg {
+	case NEA0:
+		return append([]byte{}, data...)
+	case NEA2:
+		return nea2(key, count, bearer, direction, data)
+	default:
+		return nil
+	}
+}
+
+// nasMAC applies the NIA integrity algorithm identified by alg and returns
+// the 32-bit NAS-MAC. It returns nil if alg is not implemented.
+func nasMAC(alg uint8, key []byte, count uint32, bearer, direction uint8, msg []byte) []byte {
+	switch alg {
+	case NIA0:
+		return []byte{0x00, 0x00, 0x00, 0x00}
+	case NIA2:
+		return nia2(key, count, bearer, direction, msg)
+	default:
+		return nil
+	}
+}
+
+// nea2 implements 128-NEA2 (TS 33.401 Annex B.1.3): AES-128 in CTR mode,
+// with the 128-bit initial counter block COUNT(32) || BEARER(5) ||
+// DIRECTION(1) || 0...0(90).
+func nea2(key []byte, count uint32, bearer, direction uint8, data []byte) []byte {
+
+	iv := make([]byte, 16)
+	binary.BigEndian.PutUint32(iv[0:4], count)
+	iv[4] = (bearer << 3) | (direction << 2)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil
+	}
+
+	out := make([]byte, len(data))
+	cipher.NewCTR(block, iv).XORKeyStream(out, data)
+	return out
+}
+
+// nia2 implements 128-NIA2 (TS 33.401 Annex B.2.3): AES-128 CMAC over
+// COUNT(32) || BEARER(5) || DIRECTION(1) || 0...0(26) || MESSAGE, truncated
+// to the 32 most significant bits of the CMAC tag.
+func nia2(key []byte, count uint32, bearer, direction uint8, msg []byte) []byte {
+
+	prefix := make([]byte, 8)
+	binary.BigEndian.PutUint32(prefix[0:4], count)
+	prefix[4] = (bearer << 3) | (direction << 2)
+
+	tag := aesCMAC(key, append(prefix, msg...))
+	if tag == nil {
+		return nil
+	}
+	return tag[:4]
+}
+
+// aesCMAC implements AES-128 CMAC (RFC 4493).
+func aesCMAC(key, msg []byte) []byte {
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil
+	}
+	const blockSize = aes.BlockSize
+
+	zero := make([]byte, blockSize)
+	l := make([]byte, blockSize)
+	block.Encrypt(l, zero)
+
+	k1 := cmacShiftXOR(l)
+	k2 := cmacShiftXOR(k1)
+
+	n := (len(msg) + blockSize - 1) / blockSize
+	complete := n > 0 && len(msg)%blockSize == 0
+	if n == 0 {
+		n = 1
+		complete = false
+	}
+
+	padded := make([]byte, n*blockSize)
+	copy(padded, msg)
+
+	last := padded[(n-1)*blockSize : n*blockSize]
+	if complete {
+		xorInto(last, k1)
+	} else {
+		padded[len(msg)] = 0x80
+		xorInto(last, k2)
+	}
+
+	x := make([]byte, blockSize)
+	for i := 0; i < n; i++ {
+		in := padded[i*blockSize : (i+1)*blockSize]
+		xorInto(in, x)
+		newX := make([]byte, blockSize)
+		block.Encrypt(newX, in)
+		x = newX
+	}
+
+	return x
+}
+
+// cmacShiftXOR implements the RFC 4493 subkey generation left-shift-and-
+// conditionally-XOR-with-Rb step.
+func cmacShiftXOR(in []byte) []byte {
+	const rb = 0x87
+
+	out := make([]byte, len(in))
+	var carry byte
+	for i := len(in) - 1; i >= 0; i-- {
+		out[i] = (in[i] << 1) | carry
+		carry = in[i] >> 7
+	}
+	if carry != 0 {
+		out[len(out)-1] ^= rb
+	}
+	return out
+}
+
+func xorInto(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+// 8.2.26 Security mode complete
+func (ue *UE) MakeSecurityModeComplete() (pdu []byte) {
+
+	var h NasMessageMM
+	h.ExtendedProtocolDiscriminator = EPD5GSMobilityManagement
+	h.SecurityHeaderType = SecurityHeaderTypePlain
+	h.MessageType = MessageTypeSecurityModeComplete
+
+	inner := []byte{h.ExtendedProtocolDiscriminator, h.SecurityHeaderType, h.MessageType}
+
+	return ue.EncodeSecured(inner, SecurityHeaderTypeIntegrityProtectedAndCiphered)
+}
+
+// EncodeSecured wraps a plain NAS message (itself starting with its own
+// EPD/SecurityHeaderType/MessageType, per TS 24.501 4.4.3.1) in a secured
+// NAS message header: EPD, SecurityHeaderType, NAS-MAC, SEQ, and the
+// ciphered payload. It increments the uplink NAS COUNT, overflowing into
+// its upper 24 bits as the SEQ byte wraps.
+func (ue *UE) EncodeSecured(plain []byte, headerType uint8) (pdu []byte) {
+
+	ue.traceUplink(plain)
+
+	count := ue.sec.ulCount
+	seq := uint8(count)
+	ue.sec.ulCount++
+
+	body := plain
+	if headerType == SecurityHeaderTypeIntegrityProtectedAndCiphered {
+		body = nasCipher(ue.sec.encAlg, ue.sec.kNASenc, count, nasBearer, directionUplink, plain)
+	}
+
+	msg := append([]byte{seq}, body...)
+	mac := nasMAC(ue.sec.intAlg, ue.sec.kNASint, count, nasBearer, directionUplink, msg)
+
+	pdu = append(pdu, EPD5GSMobilityManagement, headerType)
+	pdu = append(pdu, mac...)
+	pdu = append(pdu, seq)
+	pdu = append(pdu, body...)
+	return pdu
+}
@@ -0,0 +1,29 @@
+// Copyright 2019-2020 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package nas
+
+import "testing"
+
+// TestEncodeSecuredFirstMessageCountZero checks that the first secured
+// uplink message (Security Mode Complete, per TS 24.501 4.4.3.1) carries
+// SEQ/COUNT=0, matching a fresh security context's downlink numbering
+// instead of skipping straight to 1.
+func TestEncodeSecuredFirstMessageCountZero(t *testing.T) {
+	ue := new(UE) // NEA0/NIA0: EncodeSecured emits the plaintext body, seq still meaningful.
+
+	pdu := ue.MakeSecurityModeComplete()
+
+	// EPD(1) + SecurityHeaderType(1) + MAC(4) + SEQ(1) envelope.
+	const seqOffset = 6
+	if len(pdu) <= seqOffset {
+		t.Fatalf("MakeSecurityModeComplete produced %d bytes, too short", len(pdu))
+	}
+	if got := pdu[seqOffset]; got != 0 {
+		t.Errorf("SEQ = %d, want 0 for the first secured uplink message", got)
+	}
+	if ue.sec.ulCount != 1 {
+		t.Errorf("ulCount = %d, want 1 after encoding one message", ue.sec.ulCount)
+	}
+}
@@ -0,0 +1,355 @@
+// Copyright 2019-2020 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+// 5GS Session Management (5GSM), TS 24.501 clause 8.3 / 9.4, carried inside
+// an MM UL/DL NAS TRANSPORT message via the Payload Container IE.
+package nas
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// 9.1.1 NAS message format, EPD == EPD5GSSessionManagement.
+type NasMessageSM struct {
+	ExtendedProtocolDiscriminator uint8
+	PDUSessionID                  uint8
+	PTI                           uint8
+	MessageType                   uint8
+}
+
+// 9.7 Message type (5GSM messages)
+const (
+	MessageTypePDUSessionEstablishmentRequest = 0xc1
+	MessageTypePDUSessionEstablishmentAccept  = 0xc2
+	MessageTypePDUSessionEstablishmentReject  = 0xc3
+	MessageTypePDUSessionModificationRequest  = 0xc9
+	MessageTypePDUSessionModificationReject   = 0xca
+	MessageTypePDUSessionModificationCommand  = 0xcb
+	MessageTypePDUSessionModificationComplete = 0xcc
+	MessageTypePDUSessionReleaseRequest       = 0xd1
+	MessageTypePDUSessionReleaseReject        = 0xd2
+	MessageTypePDUSessionReleaseCommand       = 0xd3
+	MessageTypePDUSessionReleaseComplete      = 0xd4
+)
+
+var smMsgTypeStr = map[int]string{
+	MessageTypePDUSessionEstablishmentRequest: "PDU Session Establishment Request",
+	MessageTypePDUSessionEstablishmentAccept:  "PDU Session Establishment Accept",
+	MessageTypePDUSessionEstablishmentReject:  "PDU Session Establishment Reject",
+	MessageTypePDUSessionModificationRequest:  "PDU Session Modification Request",
+	MessageTypePDUSessionModificationReject:   "PDU Session Modification Reject",
+	MessageTypePDUSessionModificationCommand:  "PDU Session Modification Command",
+	MessageTypePDUSessionModificationComplete: "PDU Session Modification Complete",
+	MessageTypePDUSessionReleaseRequest:       "PDU Session Release Request",
+	MessageTypePDUSessionReleaseReject:        "PDU Session Release Reject",
+	MessageTypePDUSessionReleaseCommand:       "PDU Session Release Command",
+	MessageTypePDUSessionReleaseComplete:      "PDU Session Release Complete",
+}
+
+// 9.11.3.32 / 9.11.3.41 reuse: procedure transaction identity, the value
+// reserved for "no PTI in use".
+const ProcedureTransactionIdentityUnassigned = 0x00
+
+// 9.11.2.4 Payload container type
+const (
+	PayloadContainerTypeN1SMInfo = 0x1
+)
+
+// 9.11.4.8 PDU session type
+const (
+	PDUSessionTypeIPv4         = 0x1
+	PDUSessionTypeIPv6         = 0x2
+	PDUSessionTypeIPv4v6       = 0x3
+	PDUSessionTypeUnstructured = 0x4
+	PDUSessionTypeEthernet     = 0x5
+)
+
+// 9.11.4.16 SSC mode
+const (
+	SSCMode1 = 0x1
+	SSCMode2 = 0x2
+	SSCMode3 = 0x3
+)
+
+// IEIs of the optional 5GSM IEs gnbsim knows about (TS 24.501 Table 8.3.1.1/8.3.2.1/9.11).
+const (
+	ieiSMPDUSessionType                 = 0x9 // upper nibble, type 1 IE.
+	ieiSMSSCMode                        = 0xa // upper nibble, type 1 IE.
+	ieiSMIntegrityProtectionMaxDataRate = 0x13
+	ieiSMQoSRules                       = 0x7a
+	ieiSMSessionAMBR                    = 0x2a
+	ieiSMQoSFlowDescriptions            = 0x79
+	ieiSMPDUAddress                     = 0x29
+	ieiSM5GSMCause                      = 0x59
+)
+
+// IEIs of the optional UL NAS TRANSPORT IEs gnbsim knows about (TS 24.501
+// Table 8.2.9.1.1); S-NSSAI and DNN are shared with other MM messages, see
+// ieiSNSSAI/ieiDNN in nas.go.
+const (
+	ieiULRequestType = 0x8 // upper nibble, type 1 IE, 9.11.3.47.
+)
+
+// 9.11.3.47 Request type
+const (
+	RequestTypeInitial = 0x1
+)
+
+func encRequestType(requestType uint8) (b []byte) {
+	b = append(b, uint8(ieiULRequestType<<4)|requestType)
+	return
+}
+
+// 9.11.4.8 / 9.11.4.16 pack PDU session type and SSC mode into their nibble
+// IEs, TS 24.007 11.2.1.3.2 half-octet format.
+func encPDUSessionTypeSSCMode(pduSessionType, sscMode uint8) (b []byte) {
+	b = append(b, uint8(ieiSMPDUSessionType<<4)|pduSessionType)
+	b = append(b, uint8(ieiSMSSCMode<<4)|sscMode)
+	return
+}
+
+// 9.11.4.9 Integrity protection maximum data rate (mandatory in the
+// Establishment Request, so encoded as a plain V IE without an IEI).
+func encIntegrityProtectionMaxDataRate() (b []byte) {
+	const noLimit = 0xff
+	return []byte{noLimit, noLimit}
+}
+
+// 9.11.2.8 S-NSSAI
+type SNSSAI struct {
+	SST uint8
+	SD  []byte // 0 bytes if absent, otherwise 3 bytes.
+}
+
+func encSNSSAI(s SNSSAI) (b []byte) {
+	b = append(b, ieiSNSSAI)
+	if len(s.SD) == 3 {
+		b = append(b, uint8(1+len(s.SD)), s.SST)
+		b = append(b, s.SD...)
+	} else {
+		b = append(b, uint8(1), s.SST)
+	}
+	return
+}
+
+// 9.11.2.1a DNN
+func encDNN(dnn string) (b []byte) {
+	b = append(b, ieiDNN, uint8(len(dnn)))
+	b = append(b, []byte(dnn)...)
+	return
+}
+
+// 9.11.2.8 S-NSSAI (decode side, e.g. in PDU Session Establishment Accept).
+func (ue *UE) decSNSSAI(pdu *[]byte) {
+
+	length := int((*pdu)[0])
+	*pdu = (*pdu)[1:]
+
+	s := SNSSAI{SST: (*pdu)[0]}
+	if length > 1 {
+		s.SD = append([]byte{}, (*pdu)[1:length]...)
+	}
+	*pdu = (*pdu)[length:]
+
+	ue.dprinti("S-NSSAI: SST=0x%x SD=0x%02x", s.SST, s.SD)
+}
+
+// 9.11.2.1a DNN (decode side).
+func (ue *UE) decDNNIE(pdu *[]byte) {
+
+	length := int((*pdu)[0])
+	*pdu = (*pdu)[1:]
+
+	dnn := string((*pdu)[:length])
+	*pdu = (*pdu)[length:]
+
+	ue.dprinti("DNN: %s", dnn)
+}
+
+// 9.11.4.12 QoS flow descriptions
+func (ue *UE) decQoSFlowDescriptions(pdu *[]byte) {
+
+	length := int(binary.BigEndian.Uint16((*pdu)[:2]))
+	*pdu = (*pdu)[2:]
+
+	desc := (*pdu)[:length]
+	*pdu = (*pdu)[length:]
+
+	ue.dprinti("QoS Flow Descriptions: 0x%02x", desc)
+}
+
+// 9.11.4.10 PDU address
+func (ue *UE) decPDUAddress(pdu *[]byte) {
+
+	length := int((*pdu)[0])
+	*pdu = (*pdu)[1:]
+
+	addrType := (*pdu)[0] & 0x07
+	addr := (*pdu)[1:length]
+	*pdu = (*pdu)[length:]
+
+	ue.dprinti("PDU Address: type=0x%x addr=0x%02x", addrType, addr)
+}
+
+// 8.3.1.2 PDU Session Establishment Request
+func (ue *UE) encPDUSessionEstablishmentRequest(pduSessionID, pti uint8) (pdu []byte) {
+
+	var h NasMessageSM
+	h.ExtendedProtocolDiscriminator = EPD5GSSessionManagement
+	h.PDUSessionID = pduSessionID
+	h.PTI = pti
+	h.MessageType = MessageTypePDUSessionEstablishmentRequest
+
+	pdu = append(pdu, h.ExtendedProtocolDiscriminator, h.PDUSessionID, h.PTI, h.MessageType)
+	pdu = append(pdu, encIntegrityProtectionMaxDataRate()...)
+	pdu = append(pdu, encPDUSessionTypeSSCMode(PDUSessionTypeIPv4, SSCMode1)...)
+
+	return
+}
+
+// MakePDUSessionEstablishmentRequest builds a PDU Session Establishment
+// Request and wraps it in an MM UL NAS TRANSPORT message (TS 24.501
+// 8.2.9 / 8.3.1), the entry point gnbsim uses to bring up a user-plane PDU
+// session once registration has completed. S-NSSAI, DNN and Request Type
+// are IEs of the UL NAS TRANSPORT message itself (TS 24.501 Table
+// 8.2.9.1.1), not of the 5GSM payload it carries.
+func (ue *UE) MakePDUSessionEstablishmentRequest(pduSessionID uint8, dnn string, snssai SNSSAI) (pdu []byte) {
+
+	const pti = 0x01 // first PTI allocated by the UE for this transaction.
+	sm := ue.encPDUSessionEstablishmentRequest(pduSessionID, pti)
+
+	var h NasMessageMM
+	h.ExtendedProtocolDiscriminator = EPD5GSMobilityManagement
+	h.SecurityHeaderType = SecurityHeaderTypePlain
+	h.MessageType = MessageTypeULNASTransport
+
+	inner := append([]byte{h.ExtendedProtocolDiscriminator, h.SecurityHeaderType, h.MessageType}, encPayloadContainer(pduSessionID, sm)...)
+	inner = append(inner, encRequestType(RequestTypeInitial)...)
+	inner = append(inner, encSNSSAI(snssai)...)
+	inner = append(inner, encDNN(dnn)...)
+
+	return ue.EncodeSecured(inner, SecurityHeaderTypeIntegrityProtectedAndCiphered)
+}
+
+// 9.11.3.39 / 9.11.3.40 Payload container type and Payload container,
+// as carried by UL NAS TRANSPORT (TS 24.501 8.2.9).
+func encPayloadContainer(pduSessionID uint8, sm []byte) (b []byte) {
+	b = append(b, PayloadContainerTypeN1SMInfo)
+	lenbuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(lenbuf, uint16(len(sm)))
+	b = append(b, lenbuf...)
+	b = append(b, sm...)
+	// 9.11.3.41 PDU session ID, mandatory IE of UL NAS TRANSPORT for an SM message.
+	b = append(b, 0x12, pduSessionID)
+	return
+}
+
+// 8.2.10 DL NAS transport
+func (ue *UE) decDLNASTransport(pdu *[]byte) {
+
+	ue.dprint("DL NAS Transport")
+	ue.indent++
+
+	pcType := int((*pdu)[0]) & 0x0f
+	*pdu = (*pdu)[1:]
+	ue.dprinti("Payload Container Type: 0x%x", pcType)
+
+	length := int(binary.BigEndian.Uint16((*pdu)[:2]))
+	*pdu = (*pdu)[2:]
+	container := (*pdu)[:length]
+	*pdu = (*pdu)[length:]
+
+	if pcType == PayloadContainerTypeN1SMInfo {
+		ue.decSMMessage(&container)
+	}
+
+	ue.decInformationElement(pdu)
+	ue.indent--
+}
+
+func (ue *UE) decSMMessage(pdu *[]byte) {
+
+	epd := int((*pdu)[0])
+	pduSessionID := (*pdu)[1]
+	pti := (*pdu)[2]
+	msgType := int((*pdu)[3])
+	*pdu = (*pdu)[4:]
+
+	ue.dprint("SM Message: %s (0x%x)", smMsgTypeStr[msgType], msgType)
+	ue.dprinti("EPD: 0x%x, PDU Session ID: %d, PTI: %d", epd, pduSessionID, pti)
+
+	ue.smMsgType = msgType
+
+	ue.indent++
+	switch msgType {
+	case MessageTypePDUSessionEstablishmentAccept:
+		ue.decPDUSessionEstablishmentAccept(pdu)
+	case MessageTypePDUSessionEstablishmentReject:
+		ue.decPDUSessionEstablishmentReject(pdu)
+	default:
+		break
+	}
+	ue.indent--
+}
+
+// 8.3.2 PDU Session Establishment Accept
+func (ue *UE) decPDUSessionEstablishmentAccept(pdu *[]byte) {
+
+	ue.dprint("PDU Session Establishment Accept")
+
+	pduSessionType := (*pdu)[0] & 0x0f
+	sscMode := (*pdu)[1] & 0x0f
+	*pdu = (*pdu)[2:]
+	ue.dprinti("PDU Session Type: 0x%x, SSC Mode: 0x%x", pduSessionType, sscMode)
+
+	qosRulesLen := int(binary.BigEndian.Uint16((*pdu)[:2]))
+	*pdu = (*pdu)[2:]
+	qosRules := (*pdu)[:qosRulesLen]
+	*pdu = (*pdu)[qosRulesLen:]
+	ue.dprinti("QoS Rules: 0x%02x", qosRules)
+
+	sessionAMBR := (*pdu)[:6]
+	*pdu = (*pdu)[6:]
+	ue.dprinti("Session-AMBR: 0x%02x", sessionAMBR)
+
+	ue.decInformationElement(pdu)
+}
+
+// 8.3.3 PDU Session Establishment Reject
+func (ue *UE) decPDUSessionEstablishmentReject(pdu *[]byte) {
+
+	ue.dprint("PDU Session Establishment Reject")
+
+	cause := (*pdu)[0]
+	*pdu = (*pdu)[1:]
+	ue.dprinti("5GSM Cause: 0x%x (%s)", cause, sm5GSMCauseStr[cause])
+
+	ue.decInformationElement(pdu)
+}
+
+var sm5GSMCauseStr = map[uint8]string{
+	0x1d: "Insufficient resources",
+	0x1f: "Missing or unknown DNN",
+	0x20: "Unknown PDU session type",
+	0x23: "User authentication or authorization failed",
+	0x29: "Service option not supported",
+}
+
+// SM5GSMCauseString renders common 5GSM causes as text for callers that
+// only have the raw cause code, and the hex value for any other cause.
+func SM5GSMCauseString(cause uint8) string {
+	if s, ok := sm5GSMCauseStr[cause]; ok {
+		return s
+	}
+	return fmt.Sprintf("unknown 5GSM cause 0x%x", cause)
+}
+
+// LastSMMessageType returns the message type of the most recent 5GSM
+// message decSMMessage decoded, so callers driving a UE through a DL NAS
+// Transport wrapper can tell a PDU Session Establishment Accept from a
+// Reject without re-decoding the payload themselves.
+func (ue *UE) LastSMMessageType() int {
+	return ue.smMsgType
+}
@@ -0,0 +1,46 @@
+// Copyright 2019-2020 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package nas
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestMakePDUSessionEstablishmentRequestIEPlacement checks that S-NSSAI,
+// DNN and Request Type are carried as UL NAS TRANSPORT IEs, not folded
+// into the 5GSM PDU Session Establishment Request payload they wrap.
+func TestMakePDUSessionEstablishmentRequestIEPlacement(t *testing.T) {
+	ue := new(UE) // fresh security context: NEA0/NIA0, so EncodeSecured emits the plaintext body.
+
+	const pduSessionID = 1
+	snssai := SNSSAI{SST: 1}
+	pdu := ue.MakePDUSessionEstablishmentRequest(pduSessionID, "internet", snssai)
+
+	// EPD(1) + SecurityHeaderType(1) + MAC(4) + Seq(1) = 7-byte envelope
+	// added by EncodeSecured around the plaintext UL NAS TRANSPORT body.
+	if len(pdu) < 7 {
+		t.Fatalf("MakePDUSessionEstablishmentRequest produced %d bytes, too short", len(pdu))
+	}
+	body := pdu[7:]
+
+	if body[2] != MessageTypeULNASTransport {
+		t.Fatalf("MessageType = 0x%x, want UL NAS TRANSPORT (0x%x)", body[2], MessageTypeULNASTransport)
+	}
+
+	sm := ue.encPDUSessionEstablishmentRequest(pduSessionID, 0x01)
+	if bytes.Contains(body, []byte{ieiSNSSAI, 0x01, snssai.SST}) == false {
+		t.Errorf("S-NSSAI IE not found in UL NAS TRANSPORT body")
+	}
+	if bytes.Contains(body, append([]byte{ieiDNN, 0x08}, []byte("internet")...)) == false {
+		t.Errorf("DNN IE not found in UL NAS TRANSPORT body")
+	}
+	if bytes.Contains(body, sm) == false {
+		t.Errorf("5GSM payload not found in the Payload Container IE")
+	}
+	if bytes.Contains(sm, []byte{ieiSNSSAI}) || bytes.Contains(sm, []byte{ieiDNN}) {
+		t.Errorf("5GSM payload should not carry S-NSSAI/DNN itself: % x", sm)
+	}
+}
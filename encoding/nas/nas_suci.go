@@ -0,0 +1,169 @@
+// Copyright 2019-2020 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package nas
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// encSUCISchemeOutput builds the SUCI scheme output for
+// ProtectionSchemeProfileA/B (TS 33.501 Annex C.3): an ephemeral ECDH
+// public key, the AES-128-CTR ciphertext of the BCD-encoded MSIN, and a
+// truncated HMAC-SHA-256 MAC, i.e. ephemeralPubKey || ciphertext || MAC.
+func (ue *UE) encSUCISchemeOutput(scheme uint8) ([]byte, error) {
+	return ue.encSUCISchemeOutputWithPriv(scheme, nil)
+}
+
+// encSUCISchemeOutputWithPriv is encSUCISchemeOutput with the UE's
+// ephemeral ECDH private key supplied rather than freshly generated
+// (ephemPriv == nil generates one as usual), so known-answer test vectors
+// can drive the whole scheme output deterministically.
+func (ue *UE) encSUCISchemeOutputWithPriv(scheme uint8, ephemPriv []byte) ([]byte, error) {
+
+	hnPubKey, err := hex.DecodeString(ue.HomeNetworkPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid home network public key: %w", err)
+	}
+
+	var ephemPub, z []byte
+	switch {
+	case scheme == ProtectionSchemeProfileA && ephemPriv == nil:
+		ephemPub, z, err = profileAECDH(hnPubKey)
+	case scheme == ProtectionSchemeProfileA:
+		ephemPub, z, err = profileAECDHWithPriv(hnPubKey, ephemPriv)
+	case scheme == ProtectionSchemeProfileB && ephemPriv == nil:
+		ephemPub, z, err = profileBECDH(hnPubKey)
+	case scheme == ProtectionSchemeProfileB:
+		ephemPub, z, err = profileBECDHWithPriv(hnPubKey, ephemPriv)
+	default:
+		return nil, fmt.Errorf("unsupported protection scheme 0x%x", scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// TS 33.501 C.3.3: EK (128 bits) || ICB (128 bits) || MK (256 bits).
+	keyMaterial := x963KDF(z, ephemPub, 16+16+32)
+	ek := keyMaterial[0:16]
+	icb := keyMaterial[16:32]
+	mk := keyMaterial[32:64]
+
+	block, err := aes.NewCipher(ek)
+	if err != nil {
+		return nil, err
+	}
+
+	msin := Str2BCD(ue.MSIN)
+	ciphertext := make([]byte, len(msin))
+	cipher.NewCTR(block, icb).XORKeyStream(ciphertext, msin)
+
+	mac := hmac.New(sha256.New, mk)
+	mac.Write(ciphertext)
+	tag := mac.Sum(nil)[:8] // HMAC-SHA-256-64.
+
+	out := append(append([]byte{}, ephemPub...), ciphertext...)
+	out = append(out, tag...)
+	return out, nil
+}
+
+// profileAECDH performs the Curve25519 (X25519) ECDH of TS 33.501 Annex
+// C.3.4 Profile A, returning the ephemeral public key and the shared
+// secret Z.
+func profileAECDH(hnPub []byte) (ephemPub, z []byte, err error) {
+
+	var priv [32]byte
+	if _, err = rand.Read(priv[:]); err != nil {
+		return nil, nil, err
+	}
+
+	return profileAECDHWithPriv(hnPub, priv[:])
+}
+
+// profileAECDHWithPriv is profileAECDH with the UE's ephemeral private key
+// supplied rather than freshly generated, so known-answer test vectors can
+// drive the ECDH deterministically.
+func profileAECDHWithPriv(hnPub, ephemPriv []byte) (ephemPub, z []byte, err error) {
+
+	if len(hnPub) != 32 {
+		return nil, nil, fmt.Errorf("profile A home network public key must be 32 bytes")
+	}
+
+	var priv, pub, shared, hn [32]byte
+	copy(priv[:], ephemPriv)
+	curve25519.ScalarBaseMult(&pub, &priv)
+	copy(hn[:], hnPub)
+	curve25519.ScalarMult(&shared, &priv, &hn)
+
+	return pub[:], shared[:], nil
+}
+
+// profileBECDH performs the secp256r1 ECDH of TS 33.501 Annex C.3.5 Profile
+// B, returning the compressed ephemeral public key and the shared secret
+// Z (the ECDH shared X-coordinate).
+func profileBECDH(hnPub []byte) (ephemPub, z []byte, err error) {
+
+	priv, err := rand.Int(rand.Reader, elliptic.P256().Params().N)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return profileBECDHWithPriv(hnPub, priv.Bytes())
+}
+
+// profileBECDHWithPriv is profileBECDH with the UE's ephemeral private key
+// supplied rather than freshly generated, so known-answer test vectors can
+// drive the ECDH deterministically.
+func profileBECDHWithPriv(hnPub, ephemPriv []byte) (ephemPub, z []byte, err error) {
+
+	curve := elliptic.P256()
+	if len(hnPub) != 33 {
+		return nil, nil, fmt.Errorf("profile B home network public key must be 33 bytes (compressed)")
+	}
+
+	hx, hy := elliptic.UnmarshalCompressed(curve, hnPub)
+	if hx == nil {
+		return nil, nil, fmt.Errorf("invalid profile B home network public key")
+	}
+
+	ex, ey := curve.ScalarBaseMult(ephemPriv)
+	ephemPub = elliptic.MarshalCompressed(curve, ex, ey)
+
+	sx, _ := curve.ScalarMult(hx, hy, ephemPriv)
+	z = make([]byte, 32)
+	sx.FillBytes(z)
+
+	return ephemPub, z, nil
+}
+
+// x963KDF implements the ANSI-X9.63 key derivation function with SHA-256,
+// as used by TS 33.501 Annex C.3.3 to derive EK || ICB || MK from the ECDH
+// shared secret Z. sharedInfo is the UE's ephemeral public key, per Annex
+// C.3.3's "SharedInfo = ephemeral public key" requirement; a home network
+// deriving the same keys from the SUCI needs it to match.
+func x963KDF(z, sharedInfo []byte, keyLen int) []byte {
+
+	out := make([]byte, 0, keyLen+sha256.Size)
+	for counter := uint32(1); len(out) < keyLen; counter++ {
+		h := sha256.New()
+		h.Write(z)
+		cb := make([]byte, 4)
+		binary.BigEndian.PutUint32(cb, counter)
+		h.Write(cb)
+		h.Write(sharedInfo)
+		out = append(out, h.Sum(nil)...)
+	}
+
+	return out[:keyLen]
+}
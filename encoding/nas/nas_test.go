@@ -0,0 +1,48 @@
+// Copyright 2019-2020 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package nas
+
+import (
+	"testing"
+)
+
+func testRegistrationUE(scheme string) *UE {
+	ue := new(UE)
+	ue.MSIN = "0000000001"
+	ue.MCC = 1
+	ue.MNC = 1
+	ue.RoutingIndicator = 0
+	ue.ProtectionScheme = scheme
+	ue.AuthParam.K = "465b5ce8b199b49faa5f0a2ee238a6bc"
+	ue.AuthParam.OPc = "cd63cb71954a9f4e48a5994e37a02baf"
+	return ue
+}
+
+// TestMakeRegistrationRequestNullScheme checks that MakeRegistrationRequest
+// emits the full message (header, registration type, 5GS mobile identity,
+// 5GMM capability, UE security capability), not just the fixed-size
+// trailing IEs: a regression test for binary.Write silently dropping the
+// struct fields preceding the variable-length schemeOutput.
+func TestMakeRegistrationRequestNullScheme(t *testing.T) {
+	ue := testRegistrationUE("null")
+
+	pdu := ue.MakeRegistrationRequest()
+
+	// 3(header) + 1(reg type/ngKSI) + 2(5GS mobile ID length) +
+	// 1(supi format/type ID) + 3(plmn) + 2(routing indicator) +
+	// 1(protection scheme) + 1(home network public key ID) +
+	// 5(null scheme output) + 3(5GMM capability) + 6(UE security capability).
+	const want = 3 + 1 + 2 + 1 + 3 + 2 + 1 + 1 + 5 + 3 + 6
+	if len(pdu) != want {
+		t.Fatalf("MakeRegistrationRequest produced %d bytes, want %d: % x", len(pdu), want, pdu)
+	}
+
+	if got := pdu[0]; got != EPD5GSMobilityManagement {
+		t.Errorf("ExtendedProtocolDiscriminator = 0x%x, want 0x%x", got, EPD5GSMobilityManagement)
+	}
+	if got := pdu[2]; got != MessageTypeRegistrationRequest {
+		t.Errorf("MessageType = 0x%x, want 0x%x", got, MessageTypeRegistrationRequest)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2019-2020 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package nas
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Direction of a traced NAS PDU.
+const (
+	DirectionUplink   = "uplink"
+	DirectionDownlink = "downlink"
+)
+
+// TraceSink records every decoded/encoded NAS PDU gnbsim handles, for
+// offline analysis. A single TraceSink may be shared by many concurrently
+// simulated UEs (via SetTraceSink); all writes are serialized under a
+// mutex so the output file/capture is never corrupted by interleaving.
+type TraceSink struct {
+	mu   sync.Mutex
+	w    *os.File
+	pcap bool
+}
+
+// NewJSONTraceSink creates (or truncates) path and returns a TraceSink that
+// appends one JSON object per traced PDU (JSON Lines).
+func NewJSONTraceSink(path string) (*TraceSink, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &TraceSink{w: f}, nil
+}
+
+// LINKTYPE_USER0, see https://www.tcpdump.org/linktypes.html. Wireshark can
+// be told to dissect it as GTPv1-U (and from there, NAS-5GS) via
+// Edit > Preferences > Protocols > DLT_USER > "DLT_USER0" encapsulation.
+const dltUser0 = 147
+
+// NewPcapTraceSink creates (or truncates) path and returns a TraceSink that
+// writes a pcap capture, one frame per traced PDU: a minimal fake GTP-U
+// header (TS 29.281 5.1, just enough for Wireshark to hand off to its
+// NAS-5GS dissector) followed by the raw NAS PDU bytes.
+func NewPcapTraceSink(path string) (*TraceSink, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &TraceSink{w: f, pcap: true}
+	if err := s.writeFileHeader(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *TraceSink) writeFileHeader() error {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:4], 0xa1b2c3d4) // magic, microsecond resolution.
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)          // major version.
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)          // minor version.
+	binary.LittleEndian.PutUint32(hdr[16:20], 1<<16-1)  // snaplen.
+	binary.LittleEndian.PutUint32(hdr[20:24], dltUser0) // network (link-layer type).
+	_, err := s.w.Write(hdr)
+	return err
+}
+
+// Write appends one traced PDU to the sink: direction is DirectionUplink or
+// DirectionDownlink, and pdu is the NAS message bytes. gnbsim traces uplink
+// messages in plaintext, before ciphering; a secured downlink message is
+// traced once as received and once more as the inner message after
+// deciphering.
+func (s *TraceSink) Write(direction string, pdu []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ts := time.Now()
+	if s.pcap {
+		return s.writePcapRecord(ts, direction, pdu)
+	}
+	return s.writeJSONRecord(ts, direction, pdu)
+}
+
+type traceRecord struct {
+	Time      string `json:"time"`
+	Direction string `json:"direction"`
+	PDU       string `json:"pdu_hex"`
+}
+
+func (s *TraceSink) writeJSONRecord(ts time.Time, direction string, pdu []byte) error {
+	rec := traceRecord{
+		Time:      ts.Format(time.RFC3339Nano),
+		Direction: direction,
+		PDU:       fmt.Sprintf("%x", pdu),
+	}
+	return json.NewEncoder(s.w).Encode(rec)
+}
+
+func (s *TraceSink) writePcapRecord(ts time.Time, direction string, pdu []byte) error {
+
+	// flags(1) | message type(1) | length(2) | TEID(4), TEID doubles as a
+	// direction marker since there is no real GTP-U tunnel to report.
+	frame := make([]byte, 8, 8+len(pdu))
+	frame[0] = 0x30
+	frame[1] = 0xff
+	binary.BigEndian.PutUint16(frame[2:4], uint16(len(pdu)))
+	if direction == DirectionDownlink {
+		binary.BigEndian.PutUint32(frame[4:8], 1)
+	}
+	frame = append(frame, pdu...)
+
+	rec := make([]byte, 16)
+	binary.LittleEndian.PutUint32(rec[0:4], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:8], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:12], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(rec[12:16], uint32(len(frame)))
+
+	if _, err := s.w.Write(rec); err != nil {
+		return err
+	}
+	_, err := s.w.Write(frame)
+	return err
+}
+
+// EnablePcap opens path as a private pcap trace sink for ue. Use
+// SetTraceSink when several UEs should share one capture file.
+func (ue *UE) EnablePcap(path string) error {
+	sink, err := NewPcapTraceSink(path)
+	if err != nil {
+		return err
+	}
+	ue.trace = sink
+	return nil
+}
+
+// SetTraceSink installs a (possibly shared) trace sink for ue.
+func (ue *UE) SetTraceSink(sink *TraceSink) {
+	ue.trace = sink
+}
+
+func (ue *UE) traceDownlink(pdu []byte) {
+	if ue.trace != nil {
+		ue.trace.Write(DirectionDownlink, pdu)
+	}
+}
+
+func (ue *UE) traceUplink(pdu []byte) {
+	if ue.trace != nil {
+		ue.trace.Write(DirectionUplink, pdu)
+	}
+}
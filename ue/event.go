@@ -0,0 +1,60 @@
+// Copyright 2019-2020 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package ue
+
+// EventKind identifies what moved the state machine.
+type EventKind int
+
+const (
+	// RxPDU: a raw downlink NAS PDU arrived and still needs decoding; see
+	// PDU. receiveLoop only ever emits this one, deferring
+	// nas.UE.Decode/classification to Run so that all access to the
+	// shared nas.UE happens on Run's goroutine.
+	RxPDU EventKind = iota
+	// RxAuthReq: an Authentication Request (or EAP-AKA' challenge) arrived.
+	RxAuthReq
+	// RxSMC: a Security Mode Command arrived.
+	RxSMC
+	// RxRegAccept: a Registration Accept arrived.
+	RxRegAccept
+	// RxPDUSessionAccept: a PDU Session Establishment Accept arrived.
+	RxPDUSessionAccept
+	// RxReject: any *Reject message arrived.
+	RxReject
+	// TxRegReq: the UE is (re)sending a Registration Request.
+	TxRegReq
+	// Timeout: a NAS timer (see TimerKind) expired.
+	Timeout
+)
+
+// TimerKind identifies which NAS timer (TS 24.501 §10.2) fired a Timeout
+// event.
+type TimerKind int
+
+const (
+	T3510 TimerKind = iota // registration procedure.
+	T3520                  // authentication/security procedure.
+	T3521                  // de-registration procedure.
+)
+
+var timerStr = map[TimerKind]string{
+	T3510: "T3510",
+	T3520: "T3520",
+	T3521: "T3521",
+}
+
+func (t TimerKind) String() string {
+	if s, ok := timerStr[t]; ok {
+		return s
+	}
+	return "unknown timer"
+}
+
+// Event is one input to the UE state machine's Run loop.
+type Event struct {
+	Kind  EventKind
+	Timer TimerKind // only meaningful when Kind == Timeout.
+	PDU   []byte    // raw downlink NAS PDU, only meaningful when Kind == RxPDU.
+}
@@ -0,0 +1,99 @@
+// Copyright 2019-2020 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package ue
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/hhorai/gnbsim/encoding/nas"
+)
+
+// Metrics summarizes a Population run.
+type Metrics struct {
+	Attempted int
+	Succeeded int
+	Failed    int
+}
+
+// Population drives a whole roster of subscribers through registration and
+// PDU session establishment concurrently, e.g. to load-test an AMF with
+// thousands of simulated UEs.
+type Population struct {
+	Roster []RosterEntry
+	SNSSAI nas.SNSSAI
+
+	// Dial opens a new Transport to the AMF for one subscriber. Called
+	// once per roster entry, concurrently.
+	Dial func(r RosterEntry) (Transport, error)
+
+	// Logger receives one Warn per failed subscriber, if set.
+	Logger nas.Logger
+
+	mu      sync.Mutex
+	metrics Metrics
+}
+
+// Run spins up one UE per roster entry, drives each concurrently through
+// registration and PDU session establishment, and blocks until all have
+// either reached PDUSessionActive or failed.
+func (p *Population) Run() Metrics {
+
+	var wg sync.WaitGroup
+	for _, entry := range p.Roster {
+		entry := entry
+
+		p.mu.Lock()
+		p.metrics.Attempted++
+		p.mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.runOne(entry)
+		}()
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.metrics
+}
+
+func (p *Population) runOne(entry RosterEntry) {
+
+	transport, err := p.Dial(entry)
+	if err != nil {
+		p.recordFailure(entry, err)
+		return
+	}
+
+	n := &nas.UE{
+		MSIN: entry.MSIN,
+		MCC:  entry.MCC,
+		MNC:  entry.MNC,
+	}
+	n.AuthParam.K = entry.K
+	n.AuthParam.OPc = entry.OPc
+
+	u := New(n, transport, entry.DNN, p.SNSSAI)
+	if err := u.Run(); err != nil {
+		p.recordFailure(entry, err)
+		return
+	}
+
+	p.mu.Lock()
+	p.metrics.Succeeded++
+	p.mu.Unlock()
+}
+
+func (p *Population) recordFailure(entry RosterEntry, err error) {
+	p.mu.Lock()
+	p.metrics.Failed++
+	p.mu.Unlock()
+	if p.Logger != nil {
+		p.Logger.Warn(fmt.Sprintf("UE %s registration failed", entry.MSIN), "error", err)
+	}
+}
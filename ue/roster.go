@@ -0,0 +1,104 @@
+// Copyright 2019-2020 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package ue
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// RosterEntry describes one subscriber Population can drive through
+// registration and PDU session establishment.
+type RosterEntry struct {
+	MSIN string
+	MCC  int
+	MNC  int
+	K    string
+	OPc  string
+	DNN  string
+}
+
+// LoadRosterCSV reads a roster from a headerless CSV file with columns
+// msin,mcc,mnc,k,opc,dnn.
+func LoadRosterCSV(path string) ([]RosterEntry, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	roster := make([]RosterEntry, 0, len(records))
+	for n, rec := range records {
+		if len(rec) != 6 {
+			return nil, fmt.Errorf("roster line %d: expected 6 columns, got %d", n+1, len(rec))
+		}
+
+		mcc, err := strconv.Atoi(rec[1])
+		if err != nil {
+			return nil, fmt.Errorf("roster line %d: invalid mcc: %w", n+1, err)
+		}
+		mnc, err := strconv.Atoi(rec[2])
+		if err != nil {
+			return nil, fmt.Errorf("roster line %d: invalid mnc: %w", n+1, err)
+		}
+
+		roster = append(roster, RosterEntry{
+			MSIN: rec[0],
+			MCC:  mcc,
+			MNC:  mnc,
+			K:    rec[3],
+			OPc:  rec[4],
+			DNN:  rec[5],
+		})
+	}
+
+	return roster, nil
+}
+
+// LoadRosterJSON reads a roster from a JSON array of RosterEntry.
+func LoadRosterJSON(path string) ([]RosterEntry, error) {
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var roster []RosterEntry
+	if err := json.Unmarshal(b, &roster); err != nil {
+		return nil, err
+	}
+
+	return roster, nil
+}
+
+// MSINRange expands a roster template into count consecutive subscribers,
+// one per MSIN starting at startMSIN (interpreted as a decimal number),
+// all sharing the same K/OPc/DNN -- the common case of a load-test roster
+// provisioned as a single block of subscribers on the test core.
+func MSINRange(startMSIN string, count int, mcc, mnc int, k, opc, dnn string) ([]RosterEntry, error) {
+
+	start, err := strconv.Atoi(startMSIN)
+	if err != nil {
+		return nil, fmt.Errorf("invalid start MSIN %q: %w", startMSIN, err)
+	}
+
+	width := len(startMSIN)
+	roster := make([]RosterEntry, 0, count)
+	for i := 0; i < count; i++ {
+		msin := fmt.Sprintf("%0*d", width, start+i)
+		roster = append(roster, RosterEntry{MSIN: msin, MCC: mcc, MNC: mnc, K: k, OPc: opc, DNN: dnn})
+	}
+
+	return roster, nil
+}
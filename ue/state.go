@@ -0,0 +1,36 @@
+// Copyright 2019-2020 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+// Package ue drives a simulated 5GS UE through registration and PDU
+// session establishment as an explicit finite-state machine (TS 24.501
+// §5), so that gnbsim can scale from decoding a single captured exchange
+// to concurrently load-testing an AMF with thousands of simulated
+// subscribers via Population.
+package ue
+
+// State is one node of the UE registration/session state machine.
+type State int
+
+const (
+	Deregistered State = iota
+	AuthenticationInitiated
+	SecurityContextEstablished
+	Registered
+	PDUSessionActive
+)
+
+var stateStr = map[State]string{
+	Deregistered:               "Deregistered",
+	AuthenticationInitiated:    "AuthenticationInitiated",
+	SecurityContextEstablished: "SecurityContextEstablished",
+	Registered:                 "Registered",
+	PDUSessionActive:           "PDUSessionActive",
+}
+
+func (s State) String() string {
+	if str, ok := stateStr[s]; ok {
+		return str
+	}
+	return "Unknown"
+}
@@ -0,0 +1,64 @@
+// Copyright 2019-2020 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package ue
+
+import "time"
+
+// TS 24.501 Table 10.2.1: default NAS timer values and maximum
+// retransmission counts.
+const (
+	t3510Default = 15 * time.Second
+	t3510MaxRetx = 4
+
+	t3520Default = 15 * time.Second
+	t3520MaxRetx = 4
+
+	t3521Default = 15 * time.Second
+	t3521MaxRetx = 4
+)
+
+// nasTimer tracks one NAS procedure timer together with its retransmission
+// count, so the Run loop can give up (or re-send) per TS 24.501 §10.2
+// instead of waiting forever on a lost AMF response.
+type nasTimer struct {
+	kind     TimerKind
+	duration time.Duration
+	maxRetx  int
+	retx     int
+	t        *time.Timer
+}
+
+func newNASTimer(kind TimerKind) *nasTimer {
+	switch kind {
+	case T3510:
+		return &nasTimer{kind: kind, duration: t3510Default, maxRetx: t3510MaxRetx}
+	case T3520:
+		return &nasTimer{kind: kind, duration: t3520Default, maxRetx: t3520MaxRetx}
+	case T3521:
+		return &nasTimer{kind: kind, duration: t3521Default, maxRetx: t3521MaxRetx}
+	}
+	return &nasTimer{kind: kind, duration: t3510Default, maxRetx: t3510MaxRetx}
+}
+
+// start (re)arms the timer. events receives a Timeout event on expiry.
+func (nt *nasTimer) start(events chan<- Event) {
+	nt.stop()
+	nt.t = time.AfterFunc(nt.duration, func() {
+		events <- Event{Kind: Timeout, Timer: nt.kind}
+	})
+}
+
+func (nt *nasTimer) stop() {
+	if nt.t != nil {
+		nt.t.Stop()
+	}
+}
+
+// expired records one more expiry and reports whether the procedure should
+// give up (true) because maxRetx has been exceeded.
+func (nt *nasTimer) expired() (giveUp bool) {
+	nt.retx++
+	return nt.retx > nt.maxRetx
+}
@@ -0,0 +1,195 @@
+// Copyright 2019-2020 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package ue
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/hhorai/gnbsim/encoding/nas"
+)
+
+// Transport is how a UE's Run loop exchanges NAS PDUs with an AMF.
+// gnbsim's N1 transport (NGAP over SCTP, or a pcap-replay stub for
+// testing) implements this; the ue package stays free of any particular
+// network stack.
+type Transport interface {
+	Send(pdu []byte) error
+	// Recv blocks until the next downlink NAS PDU arrives, or returns an
+	// error once the UE should stop (transport closed, link lost, ...).
+	Recv() ([]byte, error)
+}
+
+// UE drives one simulated subscriber through the registration and PDU
+// session establishment procedures as the explicit state machine
+// Deregistered -> AuthenticationInitiated -> SecurityContextEstablished ->
+// Registered -> PDUSessionActive (TS 24.501 §5). NAS and the state machine
+// itself are only ever touched from the goroutine running Run: receiveLoop
+// hands raw PDUs to Run via an RxPDU event instead of decoding them itself,
+// so NAS.Decode never races with the Make*/EncodeSecured calls Run makes on
+// the same nas.UE. State is the sole method safe to call from other
+// goroutines, such as Population reporting progress.
+type UE struct {
+	NAS    *nas.UE
+	DNN    string
+	SNSSAI nas.SNSSAI
+
+	transport Transport
+	events    chan Event
+
+	mu    sync.Mutex
+	state State
+}
+
+// New creates a UE around an already-configured nas.UE (MSIN/MCC/MNC and
+// AuthParam.K/OPc already set) that will register and establish a PDU
+// session with the given DNN/S-NSSAI over transport.
+func New(n *nas.UE, transport Transport, dnn string, snssai nas.SNSSAI) *UE {
+	return &UE{
+		NAS:       n,
+		DNN:       dnn,
+		SNSSAI:    snssai,
+		transport: transport,
+		events:    make(chan Event, 8),
+	}
+}
+
+// State returns the UE's current state. Safe to call from any goroutine.
+func (u *UE) State() State {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.state
+}
+
+func (u *UE) setState(s State) {
+	u.mu.Lock()
+	u.state = s
+	u.mu.Unlock()
+}
+
+// Run drives the UE through registration and PDU session establishment
+// against transport, returning nil once PDUSessionActive is reached, or
+// an error if the procedure is rejected or a NAS timer (TS 24.501 §10.2)
+// exhausts its retransmissions.
+func (u *UE) Run() error {
+
+	go u.receiveLoop()
+
+	regReq := u.NAS.MakeRegistrationRequest()
+	if err := u.transport.Send(regReq); err != nil {
+		return err
+	}
+	u.setState(AuthenticationInitiated) // optimistic; corrected below if the AMF rejects first.
+
+	t3510 := newNASTimer(T3510)
+	t3510.start(u.events)
+	defer t3510.stop()
+
+	for ev := range u.events {
+		if ev.Kind == RxPDU {
+			kind, ok := u.decodeDownlink(ev.PDU)
+			if !ok {
+				continue
+			}
+			ev = Event{Kind: kind}
+		}
+
+		switch ev.Kind {
+		case RxAuthReq:
+			u.setState(AuthenticationInitiated)
+			var resp []byte
+			if u.NAS.IsEAPAKA() {
+				resp = u.NAS.MakeEAPAKAPrimeResponse()
+			} else {
+				resp = u.NAS.MakeAuthenticationResponse()
+			}
+			if err := u.transport.Send(resp); err != nil {
+				return err
+			}
+
+		case RxSMC:
+			u.setState(SecurityContextEstablished)
+			if err := u.transport.Send(u.NAS.MakeSecurityModeComplete()); err != nil {
+				return err
+			}
+
+		case RxRegAccept:
+			t3510.stop()
+			u.setState(Registered)
+			pduReq := u.NAS.MakePDUSessionEstablishmentRequest(1, u.DNN, u.SNSSAI)
+			if err := u.transport.Send(pduReq); err != nil {
+				return err
+			}
+
+		case RxPDUSessionAccept:
+			u.setState(PDUSessionActive)
+			return nil
+
+		case RxReject:
+			rejectedIn := u.State()
+			if rejectedIn < Registered {
+				u.setState(Deregistered)
+			}
+			return fmt.Errorf("procedure rejected in state %s", rejectedIn)
+
+		case Timeout:
+			if ev.Timer != T3510 {
+				break
+			}
+			if t3510.expired() {
+				return fmt.Errorf("%s exhausted retransmissions in state %s", ev.Timer, u.State())
+			}
+			if err := u.transport.Send(regReq); err != nil {
+				return err
+			}
+			t3510.start(u.events)
+		}
+	}
+
+	return fmt.Errorf("run exited without reaching %s", PDUSessionActive)
+}
+
+// receiveLoop only forwards what transport.Recv hands it; it never touches
+// u.NAS, so it cannot race with Run decoding/encoding on the same nas.UE.
+// It returns once transport.Recv errors; Run still terminates in that
+// case, via its own NAS timers running out of retransmissions.
+func (u *UE) receiveLoop() {
+	for {
+		raw, err := u.transport.Recv()
+		if err != nil {
+			return
+		}
+
+		u.events <- Event{Kind: RxPDU, PDU: append([]byte{}, raw...)}
+	}
+}
+
+// decodeDownlink decodes one downlink PDU and classifies it into an
+// EventKind for Run's switch. Called only from Run's goroutine, this is
+// where NAS.Decode's mutation of the shared nas.UE actually happens; ok is
+// false for a decoded message Run has no event for.
+func (u *UE) decodeDownlink(pdu []byte) (kind EventKind, ok bool) {
+	msgType := u.NAS.Decode(&pdu, len(pdu))
+
+	switch msgType {
+	case nas.MessageTypeAuthenticationRequest:
+		return RxAuthReq, true
+	case nas.MessageTypeSecurityModeCommand:
+		return RxSMC, true
+	case nas.MessageTypeRegistrationAccept:
+		return RxRegAccept, true
+	case nas.MessageTypeRegistrationReject:
+		return RxReject, true
+	case nas.MessageTypeDLNASTransport:
+		switch u.NAS.LastSMMessageType() {
+		case nas.MessageTypePDUSessionEstablishmentAccept:
+			return RxPDUSessionAccept, true
+		case nas.MessageTypePDUSessionEstablishmentReject:
+			return RxReject, true
+		}
+	}
+
+	return 0, false
+}
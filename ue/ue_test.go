@@ -0,0 +1,42 @@
+// Copyright 2019-2020 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package ue
+
+import (
+	"testing"
+
+	"github.com/hhorai/gnbsim/encoding/nas"
+)
+
+// TestDecodeDownlinkClassifiesPlainMessages checks that decodeDownlink (the
+// method Run calls to turn a raw RxPDU into an EventKind) classifies plain
+// NAS messages correctly and reports ok=false for ones Run has no event for.
+func TestDecodeDownlinkClassifiesPlainMessages(t *testing.T) {
+	cases := []struct {
+		name    string
+		msgType byte
+		wantOK  bool
+		want    EventKind
+	}{
+		{"RegistrationAccept", nas.MessageTypeRegistrationAccept, true, RxRegAccept},
+		{"RegistrationReject", nas.MessageTypeRegistrationReject, true, RxReject},
+		{"Unhandled", 0x00, false, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			u := &UE{NAS: new(nas.UE)}
+			pdu := []byte{nas.EPD5GSMobilityManagement, 0x00, c.msgType}
+
+			kind, ok := u.decodeDownlink(pdu)
+			if ok != c.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, c.wantOK)
+			}
+			if ok && kind != c.want {
+				t.Errorf("kind = %v, want %v", kind, c.want)
+			}
+		})
+	}
+}